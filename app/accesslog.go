@@ -0,0 +1,267 @@
+package app
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	AccessLogFormatJSON     = "json"
+	AccessLogFormatCommon   = "common"
+	AccessLogFormatCombined = "combined"
+	AccessLogFormatLTSV     = "ltsv"
+
+	AccessLogFieldReferer      = "referer"
+	AccessLogFieldForwardedFor = "forwarded_for"
+	AccessLogFieldTLS          = "tls"
+	AccessLogFieldRequestID    = "request_id"
+
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+func (conf AccessLogConfig) validate() error {
+	switch conf.Format {
+	case AccessLogFormatJSON, AccessLogFormatCommon, AccessLogFormatCombined, AccessLogFormatLTSV:
+	default:
+		return fmt.Errorf("アクセスログの形式が不正です。:%s", conf.Format)
+	}
+	for _, f := range conf.Fields {
+		switch f {
+		case AccessLogFieldReferer, AccessLogFieldForwardedFor, AccessLogFieldTLS, AccessLogFieldRequestID:
+		default:
+			return fmt.Errorf("アクセスログの項目が不正です。:%s", f)
+		}
+	}
+	if conf.Filename == "" {
+		return fmt.Errorf("アクセスログのファイル名がありません。")
+	}
+	return nil
+}
+
+func (conf AccessLogConfig) hasField(name string) bool {
+	for _, f := range conf.Fields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newAccessLogBuffer 1件ずつ書かずにまとめて書き込む
+func newAccessLogBuffer(conf AccessLogConfig, lj *lumberjack.Logger) *zapcore.BufferedWriteSyncer {
+	return &zapcore.BufferedWriteSyncer{
+		WS:            zapcore.AddSync(lj),
+		Size:          conf.BufferSize,
+		FlushInterval: time.Duration(conf.FlushInterval),
+	}
+}
+
+// newLumberjack ローテート付きのアクセスログファイル
+func newLumberjack(conf AccessLogConfig) *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:   filepath.Join(AccessLogPath, conf.Filename),
+		MaxSize:    conf.MaxSize,
+		MaxBackups: conf.MaxBackups,
+		MaxAge:     conf.MaxAge,
+		Compress:   conf.Compress,
+		LocalTime:  conf.LocalTime,
+	}
+}
+
+// accessLogWriter 形式ごとのアクセスログ出力
+type accessLogWriter interface {
+	write(ri responseInfo)
+	sync() error
+}
+
+func newAccessLogWriter(conf AccessLogConfig, ws zapcore.WriteSyncer) accessLogWriter {
+	switch conf.Format {
+	case AccessLogFormatCommon, AccessLogFormatCombined, AccessLogFormatLTSV:
+		return &textAccessLog{conf: conf, ws: ws}
+	}
+	return &jsonAccessLog{
+		conf: conf,
+		logger: zap.New(zapcore.NewCore(
+			zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+			ws,
+			zap.InfoLevel,
+		)),
+	}
+}
+
+type jsonAccessLog struct {
+	conf   AccessLogConfig
+	logger *zap.Logger
+}
+
+func (l *jsonAccessLog) write(ri responseInfo) {
+	fields := []zap.Field{
+		zap.String("addr", ri.addr),
+		zap.String("host", ri.host),
+		zap.String("method", ri.method),
+		zap.String("uri", ri.uri),
+		zap.String("protocol", ri.protocol),
+		zap.Int("status", ri.status),
+		zap.Int("size", ri.size),
+		zap.String("ua", ri.userAgent),
+		zap.Duration("elapse", ri.end.Sub(ri.start)),
+	}
+	if l.conf.hasField(AccessLogFieldReferer) {
+		fields = append(fields, zap.String("referer", ri.referer))
+	}
+	if l.conf.hasField(AccessLogFieldForwardedFor) {
+		fields = append(fields, zap.String("forwarded_for", ri.forwardedFor))
+	}
+	if l.conf.hasField(AccessLogFieldTLS) {
+		fields = append(fields, zap.String("tls", ri.tlsVersion))
+	}
+	if l.conf.hasField(AccessLogFieldRequestID) {
+		fields = append(fields, zap.String("request_id", ri.requestID))
+	}
+	if ri.traceID != "" {
+		fields = append(fields, zap.String("trace_id", ri.traceID))
+	}
+	l.logger.Info("-", fields...)
+}
+
+func (l *jsonAccessLog) sync() error {
+	return l.logger.Sync()
+}
+
+// textAccessLog Common/Combined Log FormatとLTSV
+type textAccessLog struct {
+	conf AccessLogConfig
+	ws   zapcore.WriteSyncer
+}
+
+var textAccessLogPool = sync.Pool{New: func() interface{} { return new(strings.Builder) }}
+
+func (l *textAccessLog) write(ri responseInfo) {
+	sb := textAccessLogPool.Get().(*strings.Builder)
+	defer func() {
+		sb.Reset()
+		textAccessLogPool.Put(sb)
+	}()
+	switch l.conf.Format {
+	case AccessLogFormatLTSV:
+		l.formatLTSV(sb, ri)
+	default:
+		formatCLF(sb, ri, l.conf.Format == AccessLogFormatCombined)
+	}
+	sb.WriteByte('\n')
+	if _, err := io.WriteString(l.ws, sb.String()); err != nil {
+		log.Warnw("アクセスログの書き込みに失敗しました。", "error", err)
+	}
+}
+
+func (l *textAccessLog) sync() error {
+	return l.ws.Sync()
+}
+
+// formatCLF Apacheの%h %l %u %t "%r" %>s %b（combinedは"%{Referer}i" "%{User-agent}i"付き）
+func formatCLF(sb *strings.Builder, ri responseInfo, combined bool) {
+	sb.WriteString(remoteHost(ri.addr))
+	sb.WriteString(" - ")
+	sb.WriteString(dash(ri.user))
+	sb.WriteString(" [")
+	sb.WriteString(ri.start.Local().Format(clfTimeFormat))
+	sb.WriteString("] \"")
+	sb.WriteString(escapeCLF(ri.method + " " + ri.uri + " " + ri.protocol))
+	sb.WriteString("\" ")
+	sb.WriteString(strconv.Itoa(ri.status))
+	sb.WriteByte(' ')
+	if ri.size == 0 {
+		sb.WriteByte('-')
+	} else {
+		sb.WriteString(strconv.Itoa(ri.size))
+	}
+	if combined {
+		sb.WriteString(" \"")
+		sb.WriteString(escapeCLF(dash(ri.referer)))
+		sb.WriteString("\" \"")
+		sb.WriteString(escapeCLF(dash(ri.userAgent)))
+		sb.WriteByte('"')
+	}
+}
+
+// formatLTSV http://ltsv.org/ のラベルに合わせる
+func (l *textAccessLog) formatLTSV(sb *strings.Builder, ri responseInfo) {
+	item := func(label, value string) {
+		if sb.Len() > 0 {
+			sb.WriteByte('\t')
+		}
+		sb.WriteString(label)
+		sb.WriteByte(':')
+		sb.WriteString(escapeLTSV(dash(value)))
+	}
+	item("time", "["+ri.start.Local().Format(clfTimeFormat)+"]")
+	item("host", remoteHost(ri.addr))
+	item("user", ri.user)
+	item("vhost", ri.host)
+	item("req", ri.method+" "+ri.uri+" "+ri.protocol)
+	item("method", ri.method)
+	item("uri", ri.uri)
+	item("protocol", ri.protocol)
+	item("status", strconv.Itoa(ri.status))
+	item("size", strconv.Itoa(ri.size))
+	item("ua", ri.userAgent)
+	item("reqtime", strconv.FormatFloat(ri.end.Sub(ri.start).Seconds(), 'f', 6, 64))
+	if l.conf.hasField(AccessLogFieldReferer) {
+		item("referer", ri.referer)
+	}
+	if l.conf.hasField(AccessLogFieldForwardedFor) {
+		item("forwardedfor", ri.forwardedFor)
+	}
+	if l.conf.hasField(AccessLogFieldTLS) {
+		item("tls", ri.tlsVersion)
+	}
+	if l.conf.hasField(AccessLogFieldRequestID) {
+		item("reqid", ri.requestID)
+	}
+}
+
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return dash(addr)
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func escapeCLF(s string) string {
+	if !strings.ContainsAny(s, "\"\\\n\r\t") {
+		return s
+	}
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(s)
+}
+
+func escapeLTSV(s string) string {
+	if !strings.ContainsAny(s, "\\\n\r\t") {
+		return s
+	}
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(s)
+}
+
+func tlsVersionName(cs *tls.ConnectionState) string {
+	if cs == nil {
+		return ""
+	}
+	return tls.VersionName(cs.Version)
+}
@@ -0,0 +1,134 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// adminHandler 管理API
+type adminHandler struct {
+	app *application
+	mux *http.ServeMux
+}
+
+type adminStatus struct {
+	Running bool         `json:"running"`
+	Last    updateStatus `json:"last"`
+}
+
+func newAdminHandler(app *application) *adminHandler {
+	h := &adminHandler{app: app, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/admin/update", h.post(h.update))
+	h.mux.HandleFunc("/admin/reconvert", h.post(h.reconvert))
+	h.mux.HandleFunc("/admin/status", h.status)
+	h.mux.HandleFunc("/admin/reload-alias", h.post(h.reloadAlias))
+	h.mux.HandleFunc("/admin/rotate-logs", h.post(h.rotateLogs))
+	return h
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		requestLogger(r.Context()).Warnw("管理APIの認証に失敗しました。", "addr", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+		if h.app.config().Admin.User != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		}
+		http.Error(w, "認証に失敗しました。", http.StatusUnauthorized)
+		return
+	}
+	requestLogger(r.Context()).Infow("管理APIを受け付けました。", "addr", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *adminHandler) authorized(r *http.Request) bool {
+	conf := h.app.config().Admin
+	if user, pass, ok := r.BasicAuth(); ok {
+		if conf.User == "" {
+			return false
+		}
+		u := subtle.ConstantTimeCompare([]byte(user), []byte(conf.User))
+		p := subtle.ConstantTimeCompare([]byte(pass), []byte(conf.Password))
+		return u&p == 1
+	}
+	auth := r.Header.Get("Authorization")
+	if conf.Token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(conf.Token)) == 1
+}
+
+// post 更新系はPOSTのみ受け付ける
+func (h *adminHandler) post(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "POSTのみ受け付けます。", http.StatusMethodNotAllowed)
+			return
+		}
+		f(w, r)
+	}
+}
+
+// update データ更新の手動実行
+func (h *adminHandler) update(w http.ResponseWriter, r *http.Request) {
+	h.trigger(w, r, false)
+}
+
+// reconvert gitの更新有無に関係なく全データを再変換
+func (h *adminHandler) reconvert(w http.ResponseWriter, r *http.Request) {
+	h.trigger(w, r, true)
+}
+
+func (h *adminHandler) trigger(w http.ResponseWriter, r *http.Request, force bool) {
+	if !h.app.scheduler.trigger(force) {
+		requestLogger(r.Context()).Infow("データ更新が実行中のため受け付けませんでした。", "force", force)
+		writeJSON(w, r, http.StatusConflict, map[string]string{"status": "running"})
+		return
+	}
+	requestLogger(r.Context()).Infow("管理APIからデータ更新を受け付けました。", "force", force)
+	writeJSON(w, r, http.StatusAccepted, map[string]string{"status": "accepted"})
+}
+
+// status 直近のデータ更新結果
+func (h *adminHandler) status(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, adminStatus{
+		Running: h.app.scheduler.isRunning(),
+		Last:    h.app.status.get(),
+	})
+}
+
+// reloadAlias 国名の表記揺れ表を読み直す
+// 変換済みデータに反映するにはreconvertが必要
+func (h *adminHandler) reloadAlias(w http.ResponseWriter, r *http.Request) {
+	n, err := loadCountryAlias(h.app.config().AliasPath)
+	if err != nil {
+		requestLogger(r.Context()).Warnw("表記揺れ表の読み込みに失敗しました。", "error", err, "path", h.app.config().AliasPath)
+		writeJSON(w, r, http.StatusInternalServerError, map[string]string{"status": "error", "error": err.Error()})
+		return
+	}
+	requestLogger(r.Context()).Infow("表記揺れ表を読み込みました。", "path", h.app.config().AliasPath, "count", n)
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{"status": "ok", "count": n})
+}
+
+// rotateLogs アクセスログのローテート
+func (h *adminHandler) rotateLogs(w http.ResponseWriter, r *http.Request) {
+	if err := h.app.accessLog.Load().Rotate(); err != nil {
+		requestLogger(r.Context()).Warnw("アクセスログのローテートに失敗しました。", "error", err)
+		writeJSON(w, r, http.StatusInternalServerError, map[string]string{"status": "error", "error": err.Error()})
+		return
+	}
+	requestLogger(r.Context()).Infow("アクセスログをローテートしました。")
+	writeJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		requestLogger(r.Context()).Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
+	}
+}
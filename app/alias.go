@@ -0,0 +1,147 @@
+package app
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sync"
+)
+
+// defaultCountryAlias 国名の表記揺れ
+var defaultCountryAlias = map[string]string{
+	// 中国
+	"Mainland China": "China",
+	"Hong Kong SAR":  "China",
+	"Hong Kong":      "China",
+	"Macau":          "China",
+	"Macao SAR":      "China",
+	// 台湾
+	// https://www.axios.com/johns-hopkins-coronavirus-map-taiwan-china-5c461906-4f1c-42e7-b78e-a4b43f4520ab.html
+	"Taiwan":              "Taiwan*",
+	"Taipei and environs": "Taiwan*",
+	// イギリス、チャンネル諸島はイギリスではない？？？
+	"UK":              "United Kingdom",
+	"North Ireland":   "United Kingdom",
+	"Cayman Islands":  "United Kingdom",
+	"Channel Islands": "United Kingdom",
+	"Gibraltar":       "United Kingdom",
+	"Jersey":          "United Kingdom",
+	"Guernsey":        "United Kingdom",
+	// アイルランド
+	"Republic of Ireland": "Ireland",
+	// アメリカ
+	"Puerto Rico": "US",
+	"Guam":        "US",
+	// コートジボワール
+	"Ivory Coast": "Cote d'Ivoire",
+	// フランスの海外県
+	"Guadeloupe":       "France",
+	"Reunion":          "France",
+	"Martinique":       "France",
+	"Mayotte":          "France",
+	"French Guiana":    "France",
+	"Saint Barthelemy": "France",
+	// 船
+	"Cruise ship": "Others",
+	"Cruise Ship": "Others",
+	// イラン
+	"Iran (Islamic Republic of)": "Iran",
+	// 韓国
+	"Republic of Korea": "Korea, South",
+	"South Korea":       "Korea, South",
+	// オランダ
+	"Aruba":   "Netherlands",
+	"Curacao": "Netherlands",
+	// バハマ
+	"Bahamas, The": "Bahamas",
+	"The Bahamas":  "Bahamas",
+	// パレスチナ
+	"Palestine":                      "State of Palestine",
+	"occupied Palestinian territory": "State of Palestine",
+	// コンゴ
+	"Republic of the Congo": "Congo",
+	"the Congo":             "Congo",
+	"Congo (Brazzaville)":   "Congo",
+	"Congo (Kinshasa)":      "Congo",
+	// モルドバ
+	"Republic of Moldova": "Moldova",
+	// セント・マーチン島（北側はフランスで南側はオランダ？？？）
+	"Saint Martin": "St. Martin",
+	"St. Martin":   "St. Martin", // どっちか分からん
+	// バチカン市国（特に表記揺れてない）
+	"Vatican City": "Vatican City",
+	// チェコ共和国
+	"Czech Republic": "Czechia",
+	// ベトナム
+	"Viet Nam": "Vietnam",
+	// ロシア
+	"Russian Federation": "Russia",
+	// デンマーク
+	"Faroe Islands": "Denmark",
+	"Greenland":     "Denmark",
+	// ガンビア
+	"Gambia, The": "Gambia",
+	"The Gambia":  "Gambia",
+	// カーボベルデ
+	"Cape Verde": "Cabo Verde",
+	// 東ティモール
+	"East Timor": "Timor-Leste",
+}
+
+// countryAlias 現在有効な表記揺れ表
+var countryAlias = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: defaultCountryAlias}
+
+// loadCountryAlias 既定の表に設定ファイルの表を上書きして差し替える
+// pが空の場合は既定の表に戻す
+func loadCountryAlias(p string) (int, error) {
+	m, err := readCountryAlias(p)
+	if err != nil {
+		return 0, err
+	}
+	setCountryAlias(m)
+	return len(m), nil
+}
+
+// readCountryAlias 差し替えずに読み込むだけ
+func readCountryAlias(p string) (map[string]string, error) {
+	m := make(map[string]string, len(defaultCountryAlias))
+	for k, v := range defaultCountryAlias {
+		m[k] = v
+	}
+	if p != "" {
+		fp, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		ext := map[string]string{}
+		if err := json.NewDecoder(fp).Decode(&ext); err != nil {
+			return nil, err
+		}
+		for k, v := range ext {
+			m[k] = v
+		}
+	}
+	return m, nil
+}
+
+// setCountryAlias 表を差し替えて、内容が変わったかを返す
+func setCountryAlias(m map[string]string) bool {
+	countryAlias.Lock()
+	defer countryAlias.Unlock()
+	changed := !reflect.DeepEqual(countryAlias.m, m)
+	countryAlias.m = m
+	return changed
+}
+
+func convertNotation(country string) string {
+	countryAlias.RLock()
+	defer countryAlias.RUnlock()
+	if c, ok := countryAlias.m[country]; ok {
+		return c
+	}
+	return country
+}
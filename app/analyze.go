@@ -0,0 +1,265 @@
+package app
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// AnalyzeOptions analyze-logsの設定
+type AnalyzeOptions struct {
+	// 対象ファイル、空の場合はDirからローテート済みのものも含めて探す
+	Files []string
+	Dir   string
+	// アクセスログのファイル名（access.log）
+	Filename string
+	// textかjson
+	Format string
+	Top    int
+	Since  time.Time
+	Until  time.Time
+}
+
+// LogReport analyze-logsの集計結果
+type LogReport struct {
+	Files     []string          `json:"files"`
+	Requests  uint64            `json:"requests"`
+	Bytes     uint64            `json:"bytes"`
+	Invalid   uint64            `json:"invalid"`
+	First     *time.Time        `json:"first,omitempty"`
+	Last      *time.Time        `json:"last,omitempty"`
+	Status    map[int]uint64    `json:"status"`
+	Latency   map[string]string `json:"latency"`
+	TopURIs   []RankItem        `json:"top_uris"`
+	TopAgents []RankItem        `json:"top_user_agents"`
+	Hourly    []HourlyTraffic   `json:"hourly"`
+	latency   *quantileSketch
+	uris      map[string]uint64
+	agents    map[string]uint64
+	hourly    map[time.Time]*HourlyTraffic
+}
+
+type RankItem struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+type HourlyTraffic struct {
+	Hour     time.Time `json:"hour"`
+	Requests uint64    `json:"requests"`
+	Bytes    uint64    `json:"bytes"`
+}
+
+// accessLogEntry JSON形式のアクセスログ1行
+type accessLogEntry struct {
+	TS     float64 `json:"ts"`
+	URI    string  `json:"uri"`
+	Status int     `json:"status"`
+	Size   int     `json:"size"`
+	UA     string  `json:"ua"`
+	Elapse float64 `json:"elapse"`
+}
+
+// AnalyzeLogs JSON形式のアクセスログ（gzip圧縮済みのバックアップを含む）を集計して出力する
+func AnalyzeLogs(w io.Writer, opts AnalyzeOptions) error {
+	files := opts.Files
+	if len(files) == 0 {
+		var err error
+		files, err = findAccessLogFiles(opts.Dir, opts.Filename)
+		if err != nil {
+			return err
+		}
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("アクセスログが見つかりませんでした。:%s", opts.Dir)
+	}
+	rep := newLogReport()
+	for _, p := range files {
+		if err := rep.readFile(p, opts); err != nil {
+			return err
+		}
+		rep.Files = append(rep.Files, p)
+	}
+	rep.finish(opts.Top)
+	switch opts.Format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(rep)
+	case "", "text":
+		return rep.writeText(w)
+	}
+	return fmt.Errorf("出力形式が不正です。:%s", opts.Format)
+}
+
+// findAccessLogFiles lumberjackのバックアップ（access-2006-01-02T15-04-05.000.log.gz）も含めて探す
+func findAccessLogFiles(dir, filename string) ([]string, error) {
+	ext := filepath.Ext(filename)
+	prefix := strings.TrimSuffix(filename, ext)
+	list, err := filepath.Glob(filepath.Join(dir, prefix+"*"+ext+"*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+func newLogReport() *LogReport {
+	return &LogReport{
+		Status:  make(map[int]uint64),
+		latency: newQuantileSketch(),
+		uris:    make(map[string]uint64),
+		agents:  make(map[string]uint64),
+		hourly:  make(map[time.Time]*HourlyTraffic),
+	}
+}
+
+func (rep *LogReport) readFile(p string, opts AnalyzeOptions) error {
+	fp, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	var r io.Reader = fp
+	if strings.HasSuffix(p, ".gz") {
+		gr, err := gzip.NewReader(fp)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var e accessLogEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil || e.URI == "" {
+			// JSON形式以外のアクセスログや壊れた行
+			rep.Invalid++
+			continue
+		}
+		sec, frac := math.Modf(e.TS)
+		t := time.Unix(int64(sec), int64(frac*1e9))
+		if !opts.Since.IsZero() && t.Before(opts.Since) {
+			continue
+		}
+		if !opts.Until.IsZero() && !t.Before(opts.Until) {
+			continue
+		}
+		rep.add(e, t)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	return nil
+}
+
+func (rep *LogReport) add(e accessLogEntry, t time.Time) {
+	rep.Requests++
+	rep.Bytes += uint64(e.Size)
+	if rep.First == nil || t.Before(*rep.First) {
+		first := t
+		rep.First = &first
+	}
+	if rep.Last == nil || t.After(*rep.Last) {
+		last := t
+		rep.Last = &last
+	}
+	rep.Status[e.Status]++
+	rep.latency.add(e.Elapse)
+	// クエリ文字列は集計しない
+	uri := e.URI
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+	rep.uris[uri]++
+	rep.agents[e.UA]++
+	h := t.Truncate(time.Hour)
+	ht, ok := rep.hourly[h]
+	if !ok {
+		ht = &HourlyTraffic{Hour: h}
+		rep.hourly[h] = ht
+	}
+	ht.Requests++
+	ht.Bytes += uint64(e.Size)
+}
+
+func (rep *LogReport) finish(top int) {
+	rep.TopURIs = rank(rep.uris, top)
+	rep.TopAgents = rank(rep.agents, top)
+	rep.Latency = make(map[string]string, 3)
+	for _, q := range []float64{0.50, 0.95, 0.99} {
+		d := time.Duration(rep.latency.quantile(q) * float64(time.Second))
+		rep.Latency["p"+strconv.Itoa(int(q*100))] = d.String()
+	}
+	rep.Hourly = make([]HourlyTraffic, 0, len(rep.hourly))
+	for _, ht := range rep.hourly {
+		rep.Hourly = append(rep.Hourly, *ht)
+	}
+	sort.Slice(rep.Hourly, func(i, j int) bool { return rep.Hourly[i].Hour.Before(rep.Hourly[j].Hour) })
+}
+
+func rank(m map[string]uint64, top int) []RankItem {
+	list := make([]RankItem, 0, len(m))
+	for name, n := range m {
+		list = append(list, RankItem{Name: name, Count: n})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Name < list[j].Name
+	})
+	if top > 0 && len(list) > top {
+		list = list[:top]
+	}
+	return list
+}
+
+func (rep *LogReport) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "files\t%d\n", len(rep.Files))
+	fmt.Fprintf(tw, "requests\t%d\n", rep.Requests)
+	fmt.Fprintf(tw, "bytes\t%d\n", rep.Bytes)
+	fmt.Fprintf(tw, "invalid lines\t%d\n", rep.Invalid)
+	if rep.First != nil {
+		fmt.Fprintf(tw, "period\t%s - %s\n", rep.First.Format(time.RFC3339), rep.Last.Format(time.RFC3339))
+	}
+	fmt.Fprintf(tw, "latency\tp50 %s\tp95 %s\tp99 %s\n", rep.Latency["p50"], rep.Latency["p95"], rep.Latency["p99"])
+
+	fmt.Fprintf(tw, "\nSTATUS\tCOUNT\n")
+	codes := make([]int, 0, len(rep.Status))
+	for code := range rep.Status {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(tw, "%d\t%d\n", code, rep.Status[code])
+	}
+
+	fmt.Fprintf(tw, "\nURI\tCOUNT\n")
+	for _, it := range rep.TopURIs {
+		fmt.Fprintf(tw, "%s\t%d\n", it.Name, it.Count)
+	}
+
+	fmt.Fprintf(tw, "\nUSER AGENT\tCOUNT\n")
+	for _, it := range rep.TopAgents {
+		fmt.Fprintf(tw, "%s\t%d\n", dash(it.Name), it.Count)
+	}
+
+	fmt.Fprintf(tw, "\nHOUR\tREQUESTS\tBYTES\n")
+	for _, ht := range rep.Hourly {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", ht.Hour.Format("2006-01-02 15:00"), ht.Requests, ht.Bytes)
+	}
+	return tw.Flush()
+}
@@ -6,9 +6,12 @@ import (
 	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"mime"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -17,12 +20,13 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
+	"github.com/tanaton/covid-19-chart/app/compact"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
-	"golang.org/x/crypto/acme/autocert"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -32,13 +36,17 @@ const (
 	DataRepoURL = "https://github.com/CSSEGISandData/COVID-19"
 
 	GitPath            = "./data/git/COVID-19"
-	RepoDataPath       = "./data/git/COVID-19/csse_covid_19_data/csse_covid_19_daily_reports"
+	RepoDataDir        = "csse_covid_19_data/csse_covid_19_daily_reports"
+	RepoDataPath       = GitPath + "/" + RepoDataDir
 	PublicPath         = "./www"
 	ConvertDataPath    = "./www/data/daily_reports/json"
 	SummaryDataPath    = "./www/data/daily_reports/summary.json"
+	CompactJSONPath    = "./www/data/daily_reports/summary.compact.json"
+	CompactBinaryPath  = "./www/data/daily_reports/summary.compact.bin"
 	AccessLogPath      = "./log"
 	NowJSONDefaultName = "2020-01-22.json"
 
+	// GitTimeoutDuration git.timeoutの既定値
 	GitTimeoutDuration  = 3 * time.Minute
 	UpdateCycleDuration = 1 * time.Hour
 )
@@ -95,11 +103,126 @@ type WorldSummary struct {
 
 type serverItem struct {
 	s *http.Server
-	f func(s *http.Server) error
+	f func(s *http.Server, ln net.Listener) error
+	// bindで開いた待ち受け
+	ln   net.Listener
+	conf ListenerConfig
+	sc   ServerConfig
+}
+
+// procGroup まとめて止める裏方処理
+type procGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newProcGroup() *procGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &procGroup{ctx: ctx, cancel: cancel}
+}
+
+func (g *procGroup) start(f func(ctx context.Context)) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		f(g.ctx)
+	}()
+}
+
+// stop 止めて終了を待つ
+func (g *procGroup) stop() {
+	g.cancel()
+	g.wg.Wait()
 }
 
 type application struct {
-	wg sync.WaitGroup
+	wg        sync.WaitGroup
+	streams   *procGroup
+	monitor   *procGroup
+	workers   *procGroup
+	conf      atomic.Pointer[Config]
+	events    *eventBroker
+	scheduler *updateScheduler
+	accessLog atomic.Pointer[lumberjack.Logger]
+	logReload chan AccessLogConfig
+	status    updateStatusHolder
+	limiter   *rateLimiter
+	routes    *routes
+	handler   swapHandler
+	serversMu sync.Mutex
+	servers   []serverItem
+	// 異常終了の原因
+	fatal atomic.Pointer[error]
+}
+
+// updateStatus 直近のデータ更新結果
+type updateStatus struct {
+	Force      bool              `json:"force"`
+	Start      *time.Time        `json:"start,omitempty"`
+	End        *time.Time        `json:"end,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Kind       string            `json:"kind,omitempty"`
+	Commit     string            `json:"commit,omitempty"`
+	Conversion *conversionResult `json:"conversion,omitempty"`
+}
+
+// updateProgress 実行中のデータ更新の進み具合
+type updateProgress struct {
+	Phase string    `json:"phase"`
+	Done  int       `json:"done,omitempty"`
+	Total int       `json:"total,omitempty"`
+	Start time.Time `json:"start"`
+}
+
+const (
+	ProgressPhaseGit     = "git"
+	ProgressPhaseConvert = "convert"
+	ProgressPhaseStore   = "store"
+)
+
+type updateStatusHolder struct {
+	sync.RWMutex
+	st  updateStatus
+	cur *updateProgress
+}
+
+func (h *updateStatusHolder) get() updateStatus {
+	h.RLock()
+	defer h.RUnlock()
+	return h.st
+}
+
+func (h *updateStatusHolder) set(st updateStatus) {
+	h.Lock()
+	defer h.Unlock()
+	h.st = st
+	h.cur = nil
+}
+
+// progress 実行中でなければnil
+func (h *updateStatusHolder) progress() *updateProgress {
+	h.RLock()
+	defer h.RUnlock()
+	if h.cur == nil {
+		return nil
+	}
+	pr := *h.cur
+	return &pr
+}
+
+// setProgress hがnilの場合は何もしない
+func (h *updateStatusHolder) setProgress(phase string, done, total int) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.cur == nil || h.cur.Phase != phase {
+		h.cur = &updateProgress{Phase: phase, Start: time.Now()}
+	}
+	h.cur.Done = done
+	h.cur.Total = total
 }
 
 var gzipContentTypeList = []string{
@@ -108,6 +231,8 @@ var gzipContentTypeList = []string{
 	"text/javascript",
 	"text/plain",
 	"application/json",
+	compact.MediaTypeJSON,
+	compact.MediaTypeBinary,
 }
 var log *zap.SugaredLogger
 var errNoUpdate = fmt.Errorf("データ未更新")
@@ -122,78 +247,235 @@ func init() {
 	mime.AddExtensionType(".json", "application/json; charset=utf-8")
 }
 
-func New() *application {
-	return &application{}
+func New(conf *Config) *application {
+	app := &application{logReload: make(chan AccessLogConfig)}
+	app.conf.Store(conf)
+	return app
+}
+
+// config 現在有効な設定
+func (app *application) config() *Config {
+	return app.conf.Load()
 }
 
 func (app *application) Run(ctx context.Context) error {
 	// 終了管理機能の起動
-	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer stop()
+	// SIGHUPの既定の動作は終了なので、起動中に受け取っても落ちないよう最初に捕まえる
+	// 起動中に届いたものは待ち受けを始めてから1回分だけ反映する
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	conf := app.config()
+	// 裏方処理はシグナルで即座に止めず、shutdownで順番に止める
+	app.streams = newProcGroup()
+	app.monitor = newProcGroup()
+	app.workers = newProcGroup()
 	if err := checkAndCreateDir(PublicPath); err != nil {
 		return err
 	}
 	if err := checkAndCreateDir(AccessLogPath); err != nil {
 		return err
 	}
-	monich := make(chan resultMonitor)
-	rich := make(chan responseInfo, 32)
+	if _, err := loadCountryAlias(conf.AliasPath); err != nil {
+		return err
+	}
+	if st, err := os.Stat(SummaryDataPath); err == nil {
+		stats.setGeneration(st.ModTime())
+	}
+	if err := loadDataMeta(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warnw("meta.jsonの読み込みに失敗", "error", err)
+	}
+	if conf.Tracing.File != "" {
+		t, err := newTracer(conf.Tracing.File)
+		if err != nil {
+			return err
+		}
+		tracing.Store(t)
+	}
+	defer func() {
+		// 再読み込みで差し替わっている場合があるので終了時点のものを閉じる
+		if t := tracing.Swap(nil); t != nil {
+			t.close()
+		}
+	}()
+	app.events = newEventBroker(app.streams.ctx)
+	// logrotateの設定がめんどくせーのでアプリでやる
+	// https://github.com/uber-go/zap/blob/master/FAQ.md
+	app.accessLog.Store(newLumberjack(conf.AccessLog))
+	monich := make(chan monitorHistory)
+	rich := make(chan responseInfo, conf.AccessLog.QueueSize)
 	jsondata := [3]aliasHandler{}
 	jsondata[0].setPath(filepath.Join(ConvertDataPath, NowJSONDefaultName))
 	jsondata[1].setPath(filepath.Join(ConvertDataPath, NowJSONDefaultName))
 	jsondata[2].setPath(filepath.Join(ConvertDataPath, NowJSONDefaultName))
 
-	// データ更新
-	updateData(ctx, true)
+	// 前回までに変換済みのデータがあればそれを配信する
 	setJSONDataPath([]alias{&jsondata[0], &jsondata[1], &jsondata[2]})
 
 	// サーバ起動
-	app.wg.Add(1)
-	go app.webServerMonitoringProc(ctx, rich, monich)
-	// 元データの更新が止まったので、定期取得も止める
-	//app.wg.Add(1)
-	//go app.updateDataProc(ctx, []alias{&jsondata[0], &jsondata[1], &jsondata[2]})
+	app.monitor.start(func(ctx context.Context) {
+		app.webServerMonitoringProc(ctx, rich, monich)
+	})
+	// 元データの更新が止まったので、定期取得は設定で有効にした場合のみ
+	first := true
+	sched, err := newUpdateScheduler(conf.Update, func(ctx context.Context, force bool) error {
+		err := app.updateData(ctx, force)
+		setJSONDataPath([]alias{&jsondata[0], &jsondata[1], &jsondata[2]})
+		if first {
+			first = false
+			// 配信できるデータが無いまま動き続けても仕方がない
+			// 終了の指示で中断した場合は失敗扱いにしない
+			if err != nil && !errors.Is(err, context.Canceled) && (unusable(err) || stats.dataGeneration().IsZero()) && app.config().Update.ExitOnFailure {
+				log.Errorw("初回のデータ更新に失敗したため終了します。", "error", err, "kind", errorKind(err))
+				app.fatal.Store(&err)
+				stop()
+			}
+		}
+		return err
+	})
+	if err != nil {
+		log.Errorw("スケジューラの作成に失敗しました。", "error", err)
+		app.fatal.Store(&err)
+		stop()
+		return app.shutdown(ctx)
+	}
+	app.scheduler = sched
+	// 初回のデータ更新は待ち受けを始めてから裏で行う
+	sched.trigger(true)
+	app.workers.start(app.updateDataProc)
 
 	// URL設定
-	http.Handle("/api/unko.in/1/monitor", &GetMonitoringHandler{ch: monich})
-	http.Handle("/data/daily_reports/today.json", &jsondata[0])
-	http.Handle("/data/daily_reports/-1day.json", &jsondata[1])
-	http.Handle("/data/daily_reports/-2day.json", &jsondata[2])
-	http.Handle("/", http.FileServer(http.FS(os.DirFS(PublicPath))))
-
 	ghfunc, err := gziphandler.GzipHandlerWithOpts(gziphandler.CompressionLevel(gzip.BestSpeed), gziphandler.ContentTypes(gzipContentTypeList))
 	if err != nil {
+		log.Errorw("サーバーハンドラの作成に失敗しました。", "error", err)
+		app.fatal.Store(&err)
 		stop()
-		log.Infow("サーバーハンドラの作成に失敗しました。", "error", err)
 		return app.shutdown(ctx)
 	}
-	h := MonitoringHandler(ghfunc(http.DefaultServeMux), rich)
+	rl, err := newRateLimiter(conf.RateLimit)
+	if err != nil {
+		log.Errorw("レート制限の作成に失敗しました。", "error", err)
+		app.fatal.Store(&err)
+		stop()
+		return app.shutdown(ctx)
+	}
+	app.limiter = rl
+	app.workers.start(rl.run)
+	app.routes = &routes{
+		gzip:     ghfunc,
+		rich:     rich,
+		limiter:  rl,
+		monitor:  tracedHandler("api.monitor", &GetMonitoringHandler{ch: monich}),
+		events:   app.events,
+		health:   newHealthChecker(app),
+		admin:    newAdminHandler(app),
+		jsondata: []http.Handler{&jsondata[0], &jsondata[1], &jsondata[2]},
+	}
+	app.handler.store(app.routes.handler(conf))
 
 	// サーバ情報
-	sl := []serverItem{
-		{
-			s: &http.Server{Addr: ":8080", Handler: h},
-			f: func(s *http.Server) error { return s.ListenAndServe() },
-		},
-		{
-			s: &http.Server{Handler: h},
-			f: func(s *http.Server) error { return s.Serve(autocert.NewListener(RootDomain)) },
-		},
+	sl := make([]serverItem, 0, len(conf.Listeners))
+	for _, lc := range activeListeners(conf) {
+		si, err := newServerItem(lc, conf.Server, &app.handler)
+		if err == nil {
+			err = si.bind()
+		}
+		if err != nil {
+			log.Errorw("サーバーの作成に失敗しました。", "error", err, "Addr", lc.Addr)
+			unbind(sl)
+			app.fatal.Store(&err)
+			stop()
+			return app.shutdown(ctx)
+		}
+		sl = append(sl, si)
 	}
+	app.startServers(sl)
+	// 設定の再読み込み
+	app.waitReload(ctx, hup)
+	// シャットダウン管理
+	return app.shutdown(ctx)
+}
+
+// routes 設定の再読み込みをまたいで使い回すハンドラ
+type routes struct {
+	gzip     func(http.Handler) http.Handler
+	rich     chan<- responseInfo
+	limiter  *rateLimiter
+	monitor  http.Handler
+	events   http.Handler
+	health   *healthChecker
+	admin    http.Handler
+	jsondata []http.Handler
+}
+
+// handler 設定に合わせてURLとミドルウェアを組み立てる
+func (rt *routes) handler(conf *Config) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/api/unko.in/1/monitor", rt.monitor)
+	mux.Handle("/api/v1/events", rt.events)
+	mux.Handle("/metrics", &MetricsHandler{})
+	mux.HandleFunc("/healthz", rt.health.healthz)
+	mux.HandleFunc("/readyz", rt.health.readyz)
+	mux.HandleFunc("/api/v1/status", rt.health.status)
+	if conf.Admin.enabled() {
+		mux.Handle("/admin/", rt.admin)
+	}
+	mux.Handle("/data/daily_reports/today.json", tracedHandler("data.file", rt.jsondata[0]))
+	mux.Handle("/data/daily_reports/-1day.json", tracedHandler("data.file", rt.jsondata[1]))
+	mux.Handle("/data/daily_reports/-2day.json", tracedHandler("data.file", rt.jsondata[2]))
+	mux.Handle("/data/daily_reports/summary.json", tracedHandler("data.summary", &summaryHandler{}))
+	mux.Handle("/", tracedHandler("static.file", newStaticHandler(conf.Static)))
+
+	// イベント配信は書き込み期限を解除するためgzipを通さない
+	gh := rt.gzip(mux)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/events" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		gh.ServeHTTP(w, r)
+	})
+	// 429もアクセスログに残すためモニタリングの内側で制限する
+	// プリフライトはレート制限の対象外にする
+	return chain(MonitoringHandler(chain(h, cors(conf.CORS), rt.limiter.middleware, rt.health.dataLoading, provenanceHeaders), rt.rich), securityMiddlewares(conf.Security)...)
+}
+
+// activeListeners 実際に待ち受ける設定
+func activeListeners(conf *Config) []ListenerConfig {
+	list := make([]ListenerConfig, 0, len(conf.Listeners))
+	for _, lc := range conf.Listeners {
+		if lc.ACME != nil && conf.DisableACME {
+			log.Infow("ACMEが無効のため待ち受けを省略します。", "Addr", lc.Addr)
+			continue
+		}
+		list = append(list, lc)
+	}
+	return list
+}
+
+// startServers 起動して稼働中の一覧に加える
+func (app *application) startServers(sl []serverItem) {
+	app.serversMu.Lock()
+	defer app.serversMu.Unlock()
 	for _, s := range sl {
-		s := s // ローカル化
-		app.wg.Add(1)
-		go s.startServer(&app.wg)
+		app.launch(s)
 	}
-	// シャットダウン管理
-	return app.shutdown(ctx, sl...)
+}
+
+// launch serversMuを取ってから呼ぶ、sはbind済みのもの
+func (app *application) launch(s serverItem) {
+	app.servers = append(app.servers, s)
+	app.wg.Add(1)
+	go s.startServer(&app.wg)
 }
 
 func (srv serverItem) startServer(wg *sync.WaitGroup) {
 	defer wg.Done()
 	log.Infow("Srv.startServer", "Addr", srv.s.Addr)
 	// サーバ起動
-	err := srv.f(srv.s)
+	err := srv.f(srv.s, srv.ln)
 	// サーバが終了した場合
 	if err != nil {
 		if err == http.ErrServerClosed {
@@ -204,111 +486,164 @@ func (srv serverItem) startServer(wg *sync.WaitGroup) {
 	}
 }
 
-func (app *application) shutdown(ctx context.Context, sl ...serverItem) error {
+// shutdown 終了の指示を待ってから順番に止める
+// 1. 待ち受けを閉じて処理中のリクエストを待つ
+// 2. 残ったアクセスログと監視情報を書き出す
+// 3. データ更新などの裏方処理を止める
+func (app *application) shutdown(ctx context.Context) error {
 	log.Infow("シグナル等の待ち受けを開始しました。")
 	// シグナル等でサーバを中断する
 	<-ctx.Done()
 	log.Infow("シャットダウン処理を開始しました。", "message", ctx.Err())
+	// イベント配信は終わらない接続なので先に切る
+	app.streams.stop()
 	// シャットダウン処理用コンテキストの用意
-	ctx, cancel := context.WithCancel(context.Background())
+	app.serversMu.Lock()
+	sl := app.servers
+	app.servers = nil
+	app.serversMu.Unlock()
+	stopServers(sl, time.Duration(app.config().Server.DrainTimeout))
+	// サーバーの終了待機
+	app.wg.Wait()
+	// 全てのリクエストが終わった後なのでアクセスログの取りこぼしは無い
+	app.monitor.stop()
+	app.workers.stop()
+	log.Infow("シャットダウン処理が完了しました。")
+	if err := app.fatal.Load(); err != nil {
+		log.Sync()
+		return *err
+	}
+	return log.Sync()
+}
+
+// stopServers 新規の受付を止め、処理中のリクエストを待ってから返る
+// 待ちきれない場合は強制的に切断する
+func stopServers(sl []serverItem, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
+	var wg sync.WaitGroup
 	for _, srv := range sl {
-		app.wg.Add(1)
+		wg.Add(1)
 		go func(ctx context.Context, srv *http.Server) {
-			ctx, cancel := context.WithTimeout(ctx, time.Second*10)
-			defer func() {
-				cancel()
-				app.wg.Done()
-			}()
+			defer wg.Done()
 			err := srv.Shutdown(ctx)
 			if err != nil {
-				log.Warnw("サーバーの終了に失敗しました。", "error", err)
+				log.Warnw("処理中のリクエストを待ちきれませんでした。", "error", err, "Addr", srv.Addr)
+				srv.Close()
 			} else {
 				log.Infow("サーバーの終了に成功しました。", "Addr", srv.Addr)
 			}
 		}(ctx, srv.s)
 	}
-	// サーバーの終了待機
-	app.wg.Wait()
-	return log.Sync()
+	wg.Wait()
 }
 
 // サーバお手軽監視用
-func (app *application) webServerMonitoringProc(ctx context.Context, rich <-chan responseInfo, monich chan<- resultMonitor) {
-	defer app.wg.Done()
-	// logrotateの設定がめんどくせーのでアプリでやる
-	// https://github.com/uber-go/zap/blob/master/FAQ.md
-	logger := zap.New(zapcore.NewCore(
-		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
-		zapcore.AddSync(&lumberjack.Logger{
-			Filename:   filepath.Join(AccessLogPath, "access.log"),
-			MaxSize:    100, // megabytes
-			MaxBackups: 100,
-			MaxAge:     7,    // days
-			Compress:   true, // disabled by default
-		}),
-		zap.InfoLevel,
-	))
-	defer logger.Sync()
-	res := resultMonitor{}
-	resmin := resultMonitor{}
+func (app *application) webServerMonitoringProc(ctx context.Context, rich <-chan responseInfo, monich chan<- monitorHistory) {
+	conf := app.config()
+	// 1件ずつ書かずにまとめて書き込む
+	ws := newAccessLogBuffer(conf.AccessLog, app.accessLog.Load())
+	logger := newAccessLogWriter(conf.AccessLog, ws)
+	defer func() {
+		// 再読み込みで差し替わっている場合があるので終了時点のものを閉じる
+		logger.sync()
+		ws.Stop()
+	}()
+	res := newResultMonitor()
+	resstart := time.Now()
+	dropped := stats.accessLogDropped()
+	rejected := stats.connectionRejected()
+	limited := stats.rateLimitedTotal()
+	hist := monitorHistory{latest: newResultMonitor()}
+	hist.latest.finalize()
+	minutes := newMonitorRing(int(time.Duration(conf.Monitor.MinuteHistory) / time.Minute))
+	hours := newMonitorRing(int(time.Duration(conf.Monitor.HourHistory) / time.Hour))
+	hour := monitorPoint{resultMonitor: newResultMonitor()}
 	tc := time.NewTicker(time.Minute)
 	defer tc.Stop()
 	for {
 		select {
 		case <-ctx.Done():
-			log.Infow("webServerMonitoringProc終了")
+			// キューに残っている分は書き出してから終わる
+			n := 0
+		drain:
+			for {
+				select {
+				case ri := <-rich:
+					logger.write(ri)
+					n++
+				default:
+					break drain
+				}
+			}
+			log.Infow("webServerMonitoringProc終了", "drain", n)
 			return
-		case monich <- resmin:
+		case monich <- hist:
+		case lc := <-app.logReload:
+			// 書きかけの分を出し切ってからファイルを開き直す
+			logger.sync()
+			ws.Stop()
+			old := app.accessLog.Swap(newLumberjack(lc))
+			if err := old.Close(); err != nil {
+				log.Warnw("アクセスログを閉じられませんでした。", "error", err)
+			}
+			ws = newAccessLogBuffer(lc, app.accessLog.Load())
+			logger = newAccessLogWriter(lc, ws)
+			log.Infow("アクセスログを開き直しました。", "filename", lc.Filename, "format", lc.Format)
 		case ri := <-rich:
-			ela := ri.end.Sub(ri.start)
-			res.ResponseCount++
-			res.ResponseTimeSum += ela
-			if ri.status < 400 {
-				res.ResponseCodeOkCount++
-			} else {
-				res.ResponseCodeNgCount++
+			res.add(ri)
+			logger.write(ri)
+		case now := <-tc.C:
+			d := stats.accessLogDropped()
+			res.AccessLogDropped = d - dropped
+			dropped = d
+			c := stats.connectionRejected()
+			res.ConnectionRejected = c - rejected
+			rejected = c
+			l := stats.rateLimitedTotal()
+			res.RateLimited = l - limited
+			limited = l
+			res.finalize()
+			p := monitorPoint{Time: resstart.Truncate(time.Minute), resultMonitor: res}
+			minutes.push(p)
+			// 1時間単位のまとめ
+			if h := p.Time.Truncate(time.Hour); !h.Equal(hour.Time) {
+				if !hour.Time.IsZero() {
+					hour.finalize()
+					hours.push(hour)
+				}
+				hour = monitorPoint{Time: h, resultMonitor: newResultMonitor()}
 			}
-			// アクセスログ出力
-			logger.Info("-",
-				zap.String("addr", ri.addr),
-				zap.String("host", ri.host),
-				zap.String("method", ri.method),
-				zap.String("uri", ri.uri),
-				zap.String("protocol", ri.protocol),
-				zap.Int("status", ri.status),
-				zap.Int("size", ri.size),
-				zap.String("ua", ri.userAgent),
-				zap.Duration("elapse", ela),
-			)
-		case <-tc.C:
-			resmin = res
-			res = resultMonitor{}
+			hour.merge(res)
+			hist = monitorHistory{
+				latest:  res,
+				minutes: minutes.list(),
+				hours:   hours.list(),
+			}
+			res = newResultMonitor()
+			resstart = now
 		}
 	}
 }
 
-func (app *application) updateDataProc(ctx context.Context, jsondata []alias) {
-	defer app.wg.Done()
-	tc := time.NewTicker(UpdateCycleDuration)
-	defer tc.Stop()
-	for {
-		select {
-		case <-ctx.Done():
-			log.Infow("updateDataProc終了")
-			return
-		case <-tc.C:
-			updateData(ctx, false)
-			setJSONDataPath(jsondata)
-		}
-	}
+func (app *application) updateDataProc(ctx context.Context) {
+	app.scheduler.run(ctx)
+	log.Infow("updateDataProc終了")
 }
 
+// setJSONDataPath 新しい日付のものから順に割り当てる
+// 書き出し中の一時ファイルは名前が日付にならないので対象外
 func setJSONDataPath(jsondata []alias) {
-	list, err := filepath.Glob(filepath.Join(ConvertDataPath, "*.json"))
+	matches, err := filepath.Glob(filepath.Join(ConvertDataPath, "*.json"))
 	if err != nil {
 		return
 	}
+	list := matches[:0]
+	for _, p := range matches {
+		if _, err := time.Parse("2006-01-02.json", filepath.Base(p)); err == nil {
+			list = append(list, p)
+		}
+	}
 	l := len(list)
 	sort.Strings(list)
 	for i := range jsondata {
@@ -319,49 +654,152 @@ func setJSONDataPath(jsondata []alias) {
 	}
 }
 
-func updateData(ctx context.Context, update bool) {
-	ctx, cancel := context.WithTimeout(ctx, GitTimeoutDuration)
-	defer cancel()
-	err := updateGitData(ctx)
+func (app *application) updateData(ctx context.Context, update bool) error {
+	start := time.Now()
+	st := updateStatus{Force: update, Start: &start}
+	err := app.updateDataFiles(ctx, update, &st)
+	end := time.Now()
+	st.End = &end
+	if err != nil {
+		st.Error = err.Error()
+		st.Kind = errorKind(err)
+	}
+	app.status.set(st)
+	return err
+}
+
+func (app *application) updateDataFiles(ctx context.Context, update bool, st *updateStatus) error {
+	app.status.setProgress(ProgressPhaseGit, 0, 0)
+	err := updateGitData(ctx, app.config().Git)
 	if !update {
 		if err == errNoUpdate {
 			log.Infow("データ更新無し")
-			return
+			return nil
 		}
 		if err != nil {
 			log.Warnw("データのupdateに失敗", "error", err)
-			return
+			return &SourceError{Err: err}
 		}
+	} else if err != nil && err != errNoUpdate {
+		// 強制変換の場合は手元に残っているデータで続ける
+		log.Warnw("データのupdateに失敗", "error", err)
 	}
 	// データファイル更新
-	updateDataFile()
+	cr, err := updateDataFile(ctx, &app.status, app.config().Update.MaxFailedRatio)
+	st.Conversion = &cr
+	if err != nil {
+		log.Warnw("updateDataFileに失敗", "error", err, "kind", errorKind(err))
+		return err
+	}
+	if cr.Failed > 0 {
+		log.Warnw("一部のファイルを変換できませんでした。", "failed", cr.Failed, "files", cr.Files)
+	}
 	log.Infow("updateDataFile完了")
+	src, err := gitCommit(GitPath)
+	if err != nil {
+		log.Infow("コミット情報の取得に失敗", "error", err)
+	}
+	err = storeDataMeta(&dataMeta{
+		Source:    src,
+		Generated: time.Now(),
+		First:     cr.First,
+		Last:      cr.Last,
+		Files:     cr.Files,
+		Failed:    cr.Failed,
+	})
+	if err != nil {
+		log.Warnw("meta.jsonの書き出しに失敗", "error", err)
+		return err
+	}
+	st.Commit = src.Hash
+	app.events.publishDataUpdated(cr, src.Hash)
+	return nil
 }
 
-func updateDataFile() error {
+// MaxReportedFailures 結果に残す変換失敗の件数
+const MaxReportedFailures = 20
+
+// conversionResult データ変換の結果
+type conversionResult struct {
+	First        string              `json:"first"`
+	Last         string              `json:"last"`
+	Files        int                 `json:"files"`
+	Failed       int                 `json:"failed"`
+	Failures     []conversionFailure `json:"failures,omitempty"`
+	RowsParsed   uint64              `json:"rows_parsed"`
+	RowsRejected uint64              `json:"rows_rejected"`
+	Duration     Duration            `json:"duration"`
+}
+
+// conversionFailure 変換できなかったファイル
+type conversionFailure struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+func (cr *conversionResult) fail(name string, err error) {
+	cr.Failed++
+	if len(cr.Failures) < MaxReportedFailures {
+		cr.Failures = append(cr.Failures, conversionFailure{File: name, Error: err.Error()})
+	}
+}
+
+// updateDataFile prは進み具合の報告先（nil可）
+// 変換に失敗したファイルの割合がmaxFailedを超えた場合は書き出さない
+// 終了の指示があった場合は途中でやめ、summaryも書き出さない
+func updateDataFile(ctx context.Context, pr *updateStatusHolder, maxFailed float64) (conversionResult, error) {
+	var cr conversionResult
+	start := time.Now()
 	if err := checkAndCreateDir(ConvertDataPath); err != nil {
-		return err
+		return cr, &WriteError{Path: ConvertDataPath, Err: err}
 	}
 	fl, err := getFileItemList()
 	if err != nil {
-		return err
+		return cr, &SourceError{Err: err}
 	}
+	cr.First = fl[0].t.Format("2006-01-02")
+	cr.Last = fl[len(fl)-1].t.Format("2006-01-02")
+	cr.Files = len(fl)
+	parsed, rejected := stats.rows()
 	ws := &WorldSummary{
 		Countrys: make(map[string]CountrySummary),
 	}
-	for _, it := range fl {
+	for i, it := range fl {
+		if err := ctx.Err(); err != nil {
+			log.Infow("データ変換を中断しました。", "done", i, "files", len(fl))
+			return cr, err
+		}
+		pr.setProgress(ProgressPhaseConvert, i, len(fl))
 		cmap, err := convertJSON(it.t, it.name)
-		if err != nil {
+		var we *WriteError
+		if errors.As(err, &we) {
+			// 書き込めない場合は続けても無駄
+			return cr, err
+		} else if err != nil {
+			log.Warnw("ファイルの変換に失敗", "file", it.name, "error", err)
+			cr.fail(it.name, err)
 			continue
 		}
 		appendSummary(ws, cmap, it.t)
 	}
-	for _, it := range ws.Countrys {
-		ws.CDR[0] += it.CDR[0]
-		ws.CDR[1] += it.CDR[1]
-		ws.CDR[2] += it.CDR[2]
+	p, r := stats.rows()
+	cr.RowsParsed = p - parsed
+	cr.RowsRejected = r - rejected
+	if cr.Failed == cr.Files || float64(cr.Failed) > float64(cr.Files)*maxFailed {
+		return cr, &ConversionError{Result: cr}
+	}
+	pr.setProgress(ProgressPhaseStore, 0, 0)
+	totalSummary(ws)
+	if err := storeSummary(ws); err != nil {
+		return cr, &WriteError{Path: SummaryDataPath, Err: err}
 	}
-	return storeSummary(ws)
+	if err := storeCompactSummary(ws); err != nil {
+		return cr, err
+	}
+	end := time.Now()
+	cr.Duration = Duration(end.Sub(start))
+	stats.setConversion(end.Sub(start), end)
+	return cr, nil
 }
 
 type fileitem struct {
@@ -406,21 +844,15 @@ func convertJSON(t time.Time, name string) (map[string]*Dataset, error) {
 		return nil, err
 	}
 	p := filepath.Join(ConvertDataPath, t.Format("2006-01-02")+".json")
-	fp, err := os.Create(p)
+	err = storeFile(p, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		//enc.SetIndent("", "\t")
+		return enc.Encode(cmap)
+	})
 	if err != nil {
 		log.Warnw("ファイル生成に失敗", "path", p, "error", err)
-		return nil, err
+		return nil, &WriteError{Path: p, Err: err}
 	}
-	defer fp.Close()
-	w := bufio.NewWriterSize(fp, 128*1024)
-	enc := json.NewEncoder(w)
-	//enc.SetIndent("", "\t")
-	err = enc.Encode(cmap)
-	if err != nil {
-		log.Warnw("JSON変換に失敗", "error", err)
-		return nil, err
-	}
-	w.Flush()
 	return cmap, nil
 }
 
@@ -442,20 +874,79 @@ func appendSummary(ws *WorldSummary, cmap map[string]*Dataset, t time.Time) *Wor
 	return ws
 }
 
+// totalSummary 国毎の最新の値を合計して全世界の値にする
+func totalSummary(ws *WorldSummary) *WorldSummary {
+	ws.CDR = [3]uint64{}
+	for _, it := range ws.Countrys {
+		ws.CDR[0] += it.CDR[0]
+		ws.CDR[1] += it.CDR[1]
+		ws.CDR[2] += it.CDR[2]
+	}
+	return ws
+}
+
 func storeSummary(ws *WorldSummary) error {
-	fp, err := os.Create(SummaryDataPath)
+	return storeFile(SummaryDataPath, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		//enc.SetIndent("", "\t")
+		return enc.Encode(ws)
+	})
+}
+
+func storeCompactSummary(ws *WorldSummary) error {
+	b := compact.NewBuilder()
+	for name, cs := range ws.Countrys {
+		for _, it := range cs.Daily {
+			b.Add(name, time.Time(it.Date), it.CDR)
+		}
+	}
+	b.SetCDR(ws.CDR)
+	s := b.Summary()
+	if err := storeFile(CompactJSONPath, func(w io.Writer) error { return compact.EncodeJSON(w, s) }); err != nil {
+		return &WriteError{Path: CompactJSONPath, Err: err}
+	}
+	if err := storeFile(CompactBinaryPath, func(w io.Writer) error { return compact.EncodeBinary(w, s) }); err != nil {
+		return &WriteError{Path: CompactBinaryPath, Err: err}
+	}
+	return nil
+}
+
+// storeFile 同じフォルダの一時ファイルに書いてから置き換える
+// 配信中のファイルを書き換えるので、書きかけの内容を返さないようにする
+func storeFile(p string, f func(w io.Writer) error) error {
+	dir, name := filepath.Split(p)
+	fp, err := os.CreateTemp(dir, "."+name+".tmp*")
 	if err != nil {
 		return err
 	}
-	defer fp.Close()
-	w := bufio.NewWriterSize(fp, 128*1024)
-	enc := json.NewEncoder(w)
-	//enc.SetIndent("", "\t")
-	err = enc.Encode(ws)
+	tmp := fp.Name()
+	err = writeTempFile(fp, f)
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
 	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func writeTempFile(fp *os.File, f func(w io.Writer) error) error {
+	// CreateTempは0600で作るのでos.Createと揃える
+	if err := fp.Chmod(0644); err != nil {
+		fp.Close()
+		return err
+	}
+	w := bufio.NewWriterSize(fp, 128*1024)
+	if err := f(w); err != nil {
+		fp.Close()
 		return err
 	}
-	return w.Flush()
+	if err := w.Flush(); err != nil {
+		fp.Close()
+		return err
+	}
+	// 書き込みの失敗がCloseで分かる場合もある
+	return fp.Close()
 }
 
 func csvToCountryMap(p string) (map[string]*Dataset, error) {
@@ -464,12 +955,16 @@ func csvToCountryMap(p string) (map[string]*Dataset, error) {
 		return nil, err
 	}
 	defer fp.Close()
+	return parseCountryCSV(fp)
+}
 
+// parseCountryCSV 日毎のCSVを国単位にまとめる
+func parseCountryCSV(rd io.Reader) (map[string]*Dataset, error) {
 	var hmax int
 	indexmap := make(map[string]int, 9)
 	cmap := make(map[string]*Dataset, 256)
 
-	r := csv.NewReader(fp)
+	r := csv.NewReader(rd)
 	// フィールドの数を可変にする
 	r.FieldsPerRecord = -1
 	if cells, err := r.Read(); err == nil {
@@ -484,12 +979,18 @@ func csvToCountryMap(p string) (map[string]*Dataset, error) {
 		// 国が無い
 		return nil, fmt.Errorf("国情報が無いよ")
 	}
+	var parsed, rejected uint64
+	defer func() {
+		stats.addRows(parsed, rejected)
+	}()
 	for cells, err := r.Read(); err == nil; cells, err = r.Read() {
 		// データ
 		if len(cells) != hmax {
 			// csv.Reader使ってるから不要？
+			rejected++
 			continue
 		}
+		parsed++
 		countrystr := convertNotation(strings.TrimSpace(cells[indexmap["Country"]]))
 		country, ok := cmap[countrystr]
 		if !ok {
@@ -507,6 +1008,7 @@ func csvToCountryMap(p string) (map[string]*Dataset, error) {
 		if index, ok := indexmap["LastUpdate"]; ok {
 			// 日付フォーマットが複数存在する問題
 			var t time.Time
+			var err error
 			lu := cells[index]
 			if strings.Contains(lu, "/") {
 				t, err = time.Parse("1/2/2006 15:04", lu)
@@ -600,65 +1102,10 @@ func headerToSubject(cell string) string {
 	return str
 }
 
-func convertNotation(country string) string {
-	switch country {
-	case "Mainland China", "Hong Kong SAR", "Hong Kong", "Macau", "Macao SAR": // 中国
-		return "China"
-	case "Taiwan", "Taipei and environs": // 台湾
-		// https://www.axios.com/johns-hopkins-coronavirus-map-taiwan-china-5c461906-4f1c-42e7-b78e-a4b43f4520ab.html
-		return "Taiwan*"
-	case "UK", "North Ireland", "Cayman Islands", "Channel Islands", "Gibraltar", "Jersey", "Guernsey": // イギリス、チャンネル諸島はイギリスではない？？？
-		return "United Kingdom"
-	case "Republic of Ireland": // アイルランド
-		return "Ireland"
-	case "Puerto Rico", "Guam": // アメリカ
-		return "US"
-	case "Ivory Coast": // コートジボワール
-		return "Cote d'Ivoire"
-	case "Guadeloupe", "Reunion", "Martinique", "Mayotte", "French Guiana", "Saint Barthelemy": // フランスの海外県
-		return "France"
-	case "Cruise ship", "Cruise Ship": // 船
-		return "Others"
-	case "Iran (Islamic Republic of)": // イラン
-		return "Iran"
-	case "Republic of Korea", "South Korea": // 韓国
-		return "Korea, South"
-	case "Aruba", "Curacao": // オランダ
-		return "Netherlands"
-	case "Bahamas, The", "The Bahamas": // バハマ
-		return "Bahamas"
-	case "Palestine", "occupied Palestinian territory": // パレスチナ
-		return "State of Palestine"
-	case "Republic of the Congo", "the Congo", "Congo (Brazzaville)", "Congo (Kinshasa)": // コンゴ
-		return "Congo"
-	case "Republic of Moldova": // モルドバ
-		return "Moldova"
-	case "Saint Martin", "St. Martin": // セント・マーチン島（北側はフランスで南側はオランダ？？？）
-		return "St. Martin" // どっちか分からん
-	case "Vatican City": // バチカン市国（特に表記揺れてない）
-		return "Vatican City"
-	case "Czech Republic": // チェコ共和国
-		return "Czechia"
-	case "Viet Nam": // ベトナム
-		return "Vietnam"
-	case "Russian Federation": // ロシア
-		return "Russia"
-	case "Faroe Islands", "Greenland": // デンマーク
-		return "Denmark"
-	case "Gambia, The", "The Gambia": // ガンビア
-		return "Gambia"
-	case "Cape Verde": // カーボベルデ
-		return "Cabo Verde"
-	case "East Timor": // 東ティモール
-		return "Timor-Leste"
-	}
-	return country
-}
-
 func checkAndCreateDir(p string) error {
 	st, err := os.Stat(p)
 	if err != nil {
-		return os.MkdirAll(p, 0666)
+		return os.MkdirAll(p, 0755)
 	}
 	if !st.IsDir() {
 		return fmt.Errorf("フォルダを期待したけどファイルでした。:%s", p)
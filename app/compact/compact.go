@@ -0,0 +1,344 @@
+// Package compact summary.jsonの列指向・差分符号化フォーマット
+//
+// 日付軸を全体で共有し、国ごとの累計値は前日との差分で保持する。
+// 同じデータをJSONとバイナリ(varint)の2種類で表現できる。
+package compact
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// MediaTypeJSON 列指向JSON形式のメディアタイプ
+	MediaTypeJSON = "application/vnd.covid-19-chart.compact+json"
+	// MediaTypeBinary バイナリ形式のメディアタイプ
+	MediaTypeBinary = "application/vnd.covid-19-chart.compact"
+
+	// DateFormat 日付軸の書式（summary.jsonと同じ）
+	DateFormat = "20060102"
+
+	binaryMagic   = "C19S"
+	binaryVersion = 1
+)
+
+var ErrInvalidFormat = errors.New("compact: 不正なフォーマットです")
+
+// Summary 列指向のサマリー
+type Summary struct {
+	Dates    []string  `json:"dates"`
+	Countrys []Country `json:"countrys"`
+	CDR      [3]uint64 `json:"cdr"`
+}
+
+// Country 国ごとの系列
+//
+// Indexは日付軸への添字、Confirmed/Deaths/Recoveredは累計値で、
+// いずれも直前の要素との差分で格納する。
+type Country struct {
+	Name      string    `json:"name"`
+	Index     []int64   `json:"index"`
+	Confirmed []int64   `json:"confirmed"`
+	Deaths    []int64   `json:"deaths"`
+	Recovered []int64   `json:"recovered"`
+	CDR       [3]uint64 `json:"cdr"`
+}
+
+// Daily 復元した1日分のデータ
+type Daily struct {
+	Date time.Time
+	CDR  [3]uint64
+}
+
+// Builder Summaryの組み立て用
+type Builder struct {
+	dates    map[string]struct{}
+	countrys map[string][]Daily
+	cdr      [3]uint64
+}
+
+func NewBuilder() *Builder {
+	return &Builder{
+		dates:    make(map[string]struct{}),
+		countrys: make(map[string][]Daily),
+	}
+}
+
+// Add 国の1日分のデータを追加する
+func (b *Builder) Add(name string, t time.Time, cdr [3]uint64) {
+	b.dates[t.Format(DateFormat)] = struct{}{}
+	b.countrys[name] = append(b.countrys[name], Daily{Date: t, CDR: cdr})
+}
+
+// SetCDR 世界全体の累計を設定する
+func (b *Builder) SetCDR(cdr [3]uint64) {
+	b.cdr = cdr
+}
+
+// Summary 差分符号化したSummaryを生成する
+func (b *Builder) Summary() *Summary {
+	s := &Summary{
+		Dates:    make([]string, 0, len(b.dates)),
+		Countrys: make([]Country, 0, len(b.countrys)),
+		CDR:      b.cdr,
+	}
+	for d := range b.dates {
+		s.Dates = append(s.Dates, d)
+	}
+	sort.Strings(s.Dates)
+	index := make(map[string]int64, len(s.Dates))
+	for i, d := range s.Dates {
+		index[d] = int64(i)
+	}
+	names := make([]string, 0, len(b.countrys))
+	for name := range b.countrys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		daily := b.countrys[name]
+		sort.SliceStable(daily, func(i, j int) bool { return daily[i].Date.Before(daily[j].Date) })
+		c := Country{
+			Name:      name,
+			Index:     make([]int64, len(daily)),
+			Confirmed: make([]int64, len(daily)),
+			Deaths:    make([]int64, len(daily)),
+			Recovered: make([]int64, len(daily)),
+		}
+		var prev Daily
+		var previ int64
+		for i, it := range daily {
+			idx := index[it.Date.Format(DateFormat)]
+			c.Index[i] = idx - previ
+			c.Confirmed[i] = int64(it.CDR[0]) - int64(prev.CDR[0])
+			c.Deaths[i] = int64(it.CDR[1]) - int64(prev.CDR[1])
+			c.Recovered[i] = int64(it.CDR[2]) - int64(prev.CDR[2])
+			prev = it
+			previ = idx
+		}
+		c.CDR = prev.CDR
+		s.Countrys = append(s.Countrys, c)
+	}
+	return s
+}
+
+// Daily 国の系列を累計値に復元する
+func (s *Summary) Daily(name string) ([]Daily, error) {
+	for i := range s.Countrys {
+		if s.Countrys[i].Name == name {
+			return s.Countrys[i].Daily(s.Dates)
+		}
+	}
+	return nil, fmt.Errorf("compact: 国が見つかりません:%s", name)
+}
+
+// Daily 差分を累計値に戻す
+func (c *Country) Daily(dates []string) ([]Daily, error) {
+	l := len(c.Index)
+	if len(c.Confirmed) != l || len(c.Deaths) != l || len(c.Recovered) != l {
+		return nil, ErrInvalidFormat
+	}
+	list := make([]Daily, 0, l)
+	var idx int64
+	var cdr [3]int64
+	for i := 0; i < l; i++ {
+		idx += c.Index[i]
+		if idx < 0 || idx >= int64(len(dates)) {
+			return nil, ErrInvalidFormat
+		}
+		t, err := time.Parse(DateFormat, dates[idx])
+		if err != nil {
+			return nil, err
+		}
+		cdr[0] += c.Confirmed[i]
+		cdr[1] += c.Deaths[i]
+		cdr[2] += c.Recovered[i]
+		list = append(list, Daily{
+			Date: t,
+			CDR:  [3]uint64{uint64(cdr[0]), uint64(cdr[1]), uint64(cdr[2])},
+		})
+	}
+	return list, nil
+}
+
+// EncodeJSON 列指向JSON形式で書き出す
+func EncodeJSON(w io.Writer, s *Summary) error {
+	return json.NewEncoder(w).Encode(s)
+}
+
+// DecodeJSON 列指向JSON形式を読み込む
+func DecodeJSON(r io.Reader) (*Summary, error) {
+	s := &Summary{}
+	if err := json.NewDecoder(r).Decode(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// EncodeBinary バイナリ形式で書き出す
+//
+// 数値は全てvarint（符号付きはzigzag）で、文字列は長さ+バイト列。
+func EncodeBinary(w io.Writer, s *Summary) error {
+	buf := make([]byte, 0, 64*1024)
+	buf = append(buf, binaryMagic...)
+	buf = append(buf, binaryVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(s.Dates)))
+	for _, d := range s.Dates {
+		buf = appendString(buf, d)
+	}
+	buf = appendCDR(buf, s.CDR)
+	buf = binary.AppendUvarint(buf, uint64(len(s.Countrys)))
+	for _, c := range s.Countrys {
+		buf = appendString(buf, c.Name)
+		buf = appendCDR(buf, c.CDR)
+		buf = binary.AppendUvarint(buf, uint64(len(c.Index)))
+		for _, list := range [][]int64{c.Index, c.Confirmed, c.Deaths, c.Recovered} {
+			if len(list) != len(c.Index) {
+				return ErrInvalidFormat
+			}
+			for _, v := range list {
+				buf = binary.AppendVarint(buf, v)
+			}
+		}
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// DecodeBinary バイナリ形式を読み込む
+func DecodeBinary(r io.Reader) (*Summary, error) {
+	br := bufio.NewReader(r)
+	head := make([]byte, len(binaryMagic)+1)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head[:len(binaryMagic)], []byte(binaryMagic)) {
+		return nil, ErrInvalidFormat
+	}
+	if head[len(binaryMagic)] != binaryVersion {
+		return nil, fmt.Errorf("compact: 未対応のバージョンです:%d", head[len(binaryMagic)])
+	}
+	s := &Summary{}
+	n, err := readLen(br)
+	if err != nil {
+		return nil, err
+	}
+	s.Dates = make([]string, 0, capHint(n))
+	for i := 0; i < n; i++ {
+		d, err := readString(br)
+		if err != nil {
+			return nil, err
+		}
+		s.Dates = append(s.Dates, d)
+	}
+	if s.CDR, err = readCDR(br); err != nil {
+		return nil, err
+	}
+	if n, err = readLen(br); err != nil {
+		return nil, err
+	}
+	s.Countrys = make([]Country, 0, capHint(n))
+	for i := 0; i < n; i++ {
+		var c Country
+		if c.Name, err = readString(br); err != nil {
+			return nil, err
+		}
+		if c.CDR, err = readCDR(br); err != nil {
+			return nil, err
+		}
+		l, err := readLen(br)
+		if err != nil {
+			return nil, err
+		}
+		// 1つの国が日付の数より多くの値を持つことはない
+		if l > len(s.Dates) {
+			return nil, ErrInvalidFormat
+		}
+		for _, list := range []*[]int64{&c.Index, &c.Confirmed, &c.Deaths, &c.Recovered} {
+			*list = make([]int64, l)
+			for j := range *list {
+				if (*list)[j], err = binary.ReadVarint(br); err != nil {
+					return nil, err
+				}
+			}
+		}
+		s.Countrys = append(s.Countrys, c)
+	}
+	return s, nil
+}
+
+// Decode 先頭のマジックナンバーを見てJSONかバイナリかを判別して読み込む
+func Decode(r io.Reader) (*Summary, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(binaryMagic))
+	if err == nil && bytes.Equal(head, []byte(binaryMagic)) {
+		return DecodeBinary(br)
+	}
+	return DecodeJSON(br)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendCDR(buf []byte, cdr [3]uint64) []byte {
+	for _, v := range cdr {
+		buf = binary.AppendUvarint(buf, v)
+	}
+	return buf
+}
+
+// readLen 要素数の読み込み（壊れたデータで巨大な領域を確保しないよう上限を設ける）
+func readLen(r *bufio.Reader) (int, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if n > 1<<24 {
+		return 0, ErrInvalidFormat
+	}
+	return int(n), nil
+}
+
+// capHint 読み込む前に確保する要素数（残りの入力長は分からないので、
+// 宣言された数をそのまま信用せず実際に読めた分だけ伸ばす）
+func capHint(n int) int {
+	return min(n, 1024)
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	n, err := readLen(r)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.Grow(capHint(n))
+	if _, err := io.CopyN(&sb, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+func readCDR(r *bufio.Reader) ([3]uint64, error) {
+	var cdr [3]uint64
+	for i := range cdr {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return cdr, err
+		}
+		cdr[i] = v
+	}
+	return cdr, nil
+}
@@ -0,0 +1,231 @@
+package compact
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func day(s string) time.Time {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// testSummary 累計値が減る（元データの修正）国と、飛び飛びの日付にしか無い国を含む
+func testSummary() (*Summary, map[string][]Daily) {
+	want := map[string][]Daily{
+		"Japan": {
+			{Date: day("2020-03-01"), CDR: [3]uint64{100, 2, 10}},
+			{Date: day("2020-03-02"), CDR: [3]uint64{120, 3, 12}},
+			{Date: day("2020-03-03"), CDR: [3]uint64{90, 1, 12}},
+			{Date: day("2020-03-04"), CDR: [3]uint64{130, 4, 20}},
+		},
+		"Italy": {
+			{Date: day("2020-03-02"), CDR: [3]uint64{500, 20, 40}},
+			{Date: day("2020-03-04"), CDR: [3]uint64{450, 25, 30}},
+		},
+		"Korea": {
+			{Date: day("2020-03-04"), CDR: [3]uint64{30, 0, 1}},
+		},
+	}
+	b := NewBuilder()
+	for name, list := range want {
+		// 日付順に並べ直されることも確かめる
+		for i := len(list) - 1; i >= 0; i-- {
+			b.Add(name, list[i].Date, list[i].CDR)
+		}
+	}
+	b.SetCDR([3]uint64{610, 29, 51})
+	return b.Summary(), want
+}
+
+func checkSummary(t *testing.T, s *Summary, want map[string][]Daily) {
+	t.Helper()
+	if got := []string{"20200301", "20200302", "20200303", "20200304"}; !reflect.DeepEqual(s.Dates, got) {
+		t.Fatalf("dates = %v, want %v", s.Dates, got)
+	}
+	if s.CDR != [3]uint64{610, 29, 51} {
+		t.Fatalf("cdr = %v", s.CDR)
+	}
+	if len(s.Countrys) != len(want) {
+		t.Fatalf("countrys = %d, want %d", len(s.Countrys), len(want))
+	}
+	for name, list := range want {
+		got, err := s.Daily(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, list) {
+			t.Fatalf("%s = %v, want %v", name, got, list)
+		}
+	}
+}
+
+func TestBuilderDelta(t *testing.T) {
+	s, _ := testSummary()
+	var italy, japan *Country
+	for i := range s.Countrys {
+		switch s.Countrys[i].Name {
+		case "Italy":
+			italy = &s.Countrys[i]
+		case "Japan":
+			japan = &s.Countrys[i]
+		}
+	}
+	if italy == nil || japan == nil {
+		t.Fatal("country not found")
+	}
+	if want := []int64{1, 2}; !reflect.DeepEqual(italy.Index, want) {
+		t.Errorf("italy index = %v, want %v", italy.Index, want)
+	}
+	if want := []int64{500, -50}; !reflect.DeepEqual(italy.Confirmed, want) {
+		t.Errorf("italy confirmed = %v, want %v", italy.Confirmed, want)
+	}
+	if want := []int64{100, 20, -30, 40}; !reflect.DeepEqual(japan.Confirmed, want) {
+		t.Errorf("japan confirmed = %v, want %v", japan.Confirmed, want)
+	}
+	if japan.CDR != [3]uint64{130, 4, 20} {
+		t.Errorf("japan cdr = %v", japan.CDR)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		encode func(w *bytes.Buffer, s *Summary) error
+		decode func(r *bytes.Buffer) (*Summary, error)
+	}{
+		{"json", func(w *bytes.Buffer, s *Summary) error { return EncodeJSON(w, s) }, func(r *bytes.Buffer) (*Summary, error) { return DecodeJSON(r) }},
+		{"binary", func(w *bytes.Buffer, s *Summary) error { return EncodeBinary(w, s) }, func(r *bytes.Buffer) (*Summary, error) { return DecodeBinary(r) }},
+		{"detect json", func(w *bytes.Buffer, s *Summary) error { return EncodeJSON(w, s) }, func(r *bytes.Buffer) (*Summary, error) { return Decode(r) }},
+		{"detect binary", func(w *bytes.Buffer, s *Summary) error { return EncodeBinary(w, s) }, func(r *bytes.Buffer) (*Summary, error) { return Decode(r) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, want := testSummary()
+			var buf bytes.Buffer
+			if err := tt.encode(&buf, s); err != nil {
+				t.Fatal(err)
+			}
+			got, err := tt.decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, s) {
+				t.Fatalf("decoded = %+v, want %+v", got, s)
+			}
+			checkSummary(t, got, want)
+		})
+	}
+}
+
+func TestDecodeBinaryTruncated(t *testing.T) {
+	s, _ := testSummary()
+	var buf bytes.Buffer
+	if err := EncodeBinary(&buf, s); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	for i := 0; i < len(b); i++ {
+		if _, err := DecodeBinary(bytes.NewReader(b[:i])); err == nil {
+			t.Fatalf("%d/%d bytes: want error", i, len(b))
+		}
+	}
+}
+
+func TestDecodeBinaryCorrupt(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"magic", []byte("XXXX\x01\x00"), ErrInvalidFormat},
+		{"version", []byte("C19S\x09\x00"), nil},
+		// 日付の数が上限を超える
+		{"length", append([]byte("C19S\x01"), 0xff, 0xff, 0xff, 0xff, 0x0f), ErrInvalidFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeBinary(bytes.NewReader(tt.data))
+			if err == nil {
+				t.Fatal("want error")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// 宣言された要素数が大きくても、実際の入力長に見合った分しか確保しない
+func TestDecodeBinaryHugeLength(t *testing.T) {
+	huge := binary.AppendUvarint(nil, 1<<24)
+	header := func(b ...[]byte) []byte {
+		return bytes.Join(append([][]byte{[]byte("C19S\x01")}, b...), nil)
+	}
+	oneDate := []byte("\x01\x0820200301\x00\x00\x00")
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"dates", header(huge), nil},
+		{"date string", header([]byte{0x01}, huge), nil},
+		{"countrys", header([]byte("\x00\x00\x00\x00"), huge), nil},
+		{"country name", header(oneDate, []byte{0x01}, huge), nil},
+		// 国の値の数は日付の数を超えられない
+		{"country values", header(oneDate, []byte("\x01\x05Japan\x00\x00\x00"), huge), ErrInvalidFormat},
+		{"country values over dates", header(oneDate, []byte("\x01\x05Japan\x00\x00\x00\x02")), ErrInvalidFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, err := DecodeBinary(bytes.NewReader(tt.data))
+			runtime.ReadMemStats(&after)
+			if err == nil {
+				t.Fatal("want error")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+				t.Fatalf("%d bytes input allocated %d bytes", len(tt.data), n)
+			}
+		})
+	}
+}
+
+func TestDailyCorrupt(t *testing.T) {
+	dates := []string{"20200301", "20200302"}
+	tests := []struct {
+		name string
+		c    Country
+	}{
+		{"index out of range", Country{Index: []int64{2}, Confirmed: []int64{1}, Deaths: []int64{0}, Recovered: []int64{0}}},
+		{"negative index", Country{Index: []int64{1, -2}, Confirmed: []int64{1, 1}, Deaths: []int64{0, 0}, Recovered: []int64{0, 0}}},
+		{"length mismatch", Country{Index: []int64{0, 1}, Confirmed: []int64{1}, Deaths: []int64{0, 0}, Recovered: []int64{0, 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.c.Daily(dates); !errors.Is(err, ErrInvalidFormat) {
+				t.Fatalf("err = %v, want %v", err, ErrInvalidFormat)
+			}
+		})
+	}
+}
+
+func TestDecodeJSONCorrupt(t *testing.T) {
+	for _, data := range []string{"", "{", `{"dates":"x"}`} {
+		if _, err := DecodeJSON(bytes.NewBufferString(data)); err == nil {
+			t.Fatalf("%q: want error", data)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Duration JSONで"1h30m"のような文字列を扱うための時間
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	t, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(t)
+	return nil
+}
+
+// Config 設定ファイルの内容
+type Config struct {
+	Listeners []ListenerConfig `json:"listeners"`
+	// trueの場合はACMEの待ち受けを起動しない
+	DisableACME bool            `json:"disable_acme"`
+	Server      ServerConfig    `json:"server"`
+	RateLimit   RateLimitConfig `json:"rate_limit"`
+	CORS        CORSConfig      `json:"cors"`
+	Update      UpdateConfig    `json:"update"`
+	Git         GitConfig       `json:"git"`
+	Admin       AdminConfig     `json:"admin"`
+	Monitor     MonitorConfig   `json:"monitor"`
+	AccessLog   AccessLogConfig `json:"access_log"`
+	Health      HealthConfig    `json:"health"`
+	Tracing     TracingConfig   `json:"tracing"`
+	Security    SecurityConfig  `json:"security"`
+	Static      StaticConfig    `json:"static"`
+	// 国名の表記揺れ表（JSON）のパス、既定の表に追加・上書きされる
+	AliasPath string `json:"alias_path"`
+	// 読み込んだ設定ファイル、SIGHUPでここから読み直す
+	path string
+}
+
+// UpdateConfig 定期更新の設定
+type UpdateConfig struct {
+	// 元データの更新が止まったので、既定では定期取得しない
+	Enable bool `json:"enable"`
+	// cron形式（分 時 日 月 曜日）か@hourly、@every 1hなど
+	Schedule   string   `json:"schedule"`
+	Jitter     Duration `json:"jitter"`
+	BackoffMin Duration `json:"backoff_min"`
+	BackoffMax Duration `json:"backoff_max"`
+	// 変換に失敗したファイルの割合がこれを超えたらデータを差し替えない
+	MaxFailedRatio float64 `json:"max_failed_ratio"`
+	// 初回のデータ更新で使えるデータを作れなかった場合は異常終了する
+	ExitOnFailure bool `json:"exit_on_failure"`
+}
+
+// MonitorConfig 監視用の履歴の保持期間
+type MonitorConfig struct {
+	// 1分単位の履歴
+	MinuteHistory Duration `json:"minute_history"`
+	// 1時間単位の履歴
+	HourHistory Duration `json:"hour_history"`
+}
+
+// AccessLogConfig アクセスログの設定
+type AccessLogConfig struct {
+	// json、common、combined、ltsvのいずれか
+	Format string `json:"format"`
+	// jsonとltsvに追加する項目（referer、forwarded_for、tls、request_id）
+	Fields []string `json:"fields"`
+	// ローテートの設定
+	Filename   string `json:"filename"`
+	MaxSize    int    `json:"max_size"` // megabytes
+	MaxBackups int    `json:"max_backups"`
+	MaxAge     int    `json:"max_age"` // days
+	Compress   bool   `json:"compress"`
+	LocalTime  bool   `json:"local_time"`
+	// 書き込み待ちの最大件数、溢れた分は捨てて件数だけ数える
+	QueueSize int `json:"queue_size"`
+	// まとめて書き込むバッファの大きさ（バイト）
+	BufferSize int `json:"buffer_size"`
+	// バッファの書き出し間隔
+	FlushInterval Duration `json:"flush_interval"`
+}
+
+// HealthConfig /readyzの判定条件
+type HealthConfig struct {
+	// 変換済みデータの許容する古さ、0なら判定しない
+	MaxDataAge Duration `json:"max_data_age"`
+	// 元データのgitリポジトリに接続できることを条件にする
+	RequireGit bool `json:"require_git"`
+	// gitの接続確認の間隔（結果はこの間キャッシュする）
+	GitCheckInterval Duration `json:"git_check_interval"`
+}
+
+// TracingConfig スパンの出力設定
+// Fileが空の場合はトレースしない
+type TracingConfig struct {
+	File string `json:"file"`
+}
+
+// AdminConfig 管理APIの設定
+// TokenとUserが両方空の場合は管理APIを無効にする
+type AdminConfig struct {
+	Token    string `json:"token"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+func (conf AdminConfig) enabled() bool {
+	return conf.Token != "" || conf.User != ""
+}
+
+// DefaultConfig 設定ファイルが無い場合の既定値
+func DefaultConfig() *Config {
+	return &Config{
+		Listeners: defaultListeners(),
+		Server:    defaultServerConfig(),
+		RateLimit: defaultRateLimitConfig(),
+		CORS:      defaultCORSConfig(),
+		Git:       defaultGitConfig(),
+		Update: UpdateConfig{
+			Enable:         false,
+			Schedule:       "@every " + UpdateCycleDuration.String(),
+			Jitter:         Duration(time.Minute),
+			BackoffMin:     Duration(time.Minute),
+			BackoffMax:     Duration(UpdateCycleDuration),
+			MaxFailedRatio: 0.1,
+		},
+		Monitor: MonitorConfig{
+			MinuteHistory: Duration(24 * time.Hour),
+			HourHistory:   Duration(7 * 24 * time.Hour),
+		},
+		Security: defaultSecurityConfig(),
+		Health: HealthConfig{
+			GitCheckInterval: Duration(5 * time.Minute),
+		},
+		AccessLog: AccessLogConfig{
+			Format:        "json",
+			Fields:        []string{AccessLogFieldRequestID},
+			Filename:      "access.log",
+			MaxSize:       100,
+			MaxBackups:    100,
+			MaxAge:        7,
+			Compress:      true,
+			QueueSize:     1024,
+			BufferSize:    256 * 1024,
+			FlushInterval: Duration(time.Second),
+		},
+	}
+}
+
+// LoadConfig 設定ファイルを読み込む
+// pが空の場合は既定値を返す
+func LoadConfig(p string) (*Config, error) {
+	conf := DefaultConfig()
+	if p == "" {
+		return conf, nil
+	}
+	fp, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	// 構造体の配列は既定値の要素に上書きされてしまうので空にしてから読む
+	conf.Listeners = nil
+	conf.RateLimit.Rules = nil
+	dec := json.NewDecoder(fp)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(conf); err != nil {
+		return nil, fmt.Errorf("設定ファイルの読み込みに失敗しました。:%s %w", p, err)
+	}
+	if conf.Listeners == nil {
+		conf.Listeners = defaultListeners()
+	}
+	if conf.RateLimit.Rules == nil {
+		conf.RateLimit.Rules = defaultRateLimitConfig().Rules
+	}
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	conf.path = p
+	return conf, nil
+}
+
+// keepStatic 再起動しないと反映できない項目は現在の値を引き継ぎ、変更されていた項目名を返す
+func (conf *Config) keepStatic(cur *Config) []string {
+	var ignored []string
+	if conf.Update != cur.Update {
+		ignored = append(ignored, "update")
+		conf.Update = cur.Update
+	}
+	if conf.Monitor != cur.Monitor {
+		ignored = append(ignored, "monitor")
+		conf.Monitor = cur.Monitor
+	}
+	if conf.AccessLog.QueueSize != cur.AccessLog.QueueSize {
+		ignored = append(ignored, "access_log.queue_size")
+		conf.AccessLog.QueueSize = cur.AccessLog.QueueSize
+	}
+	return ignored
+}
+
+func (conf *Config) validate() error {
+	if len(conf.Listeners) == 0 {
+		return fmt.Errorf("待ち受けの設定がありません。")
+	}
+	addrs := map[string]struct{}{}
+	for _, l := range conf.Listeners {
+		if err := l.validate(); err != nil {
+			return err
+		}
+		if _, ok := addrs[l.Addr]; ok {
+			return fmt.Errorf("待ち受けアドレスが重複しています。:%s", l.Addr)
+		}
+		addrs[l.Addr] = struct{}{}
+	}
+	if err := conf.Server.validate(); err != nil {
+		return err
+	}
+	if err := conf.Git.validate(); err != nil {
+		return err
+	}
+	if err := conf.Static.validate(); err != nil {
+		return err
+	}
+	if err := conf.CORS.validate(); err != nil {
+		return err
+	}
+	if err := conf.RateLimit.validate(); err != nil {
+		return err
+	}
+	if _, err := parseSchedule(conf.Update.Schedule); err != nil {
+		return err
+	}
+	if conf.Admin.User != "" && conf.Admin.Password == "" {
+		return fmt.Errorf("管理APIのパスワードが設定されていません。")
+	}
+	if conf.Monitor.MinuteHistory < Duration(time.Minute) || conf.Monitor.HourHistory < Duration(time.Hour) {
+		return fmt.Errorf("監視履歴の保持期間が短すぎます。")
+	}
+	if conf.AccessLog.QueueSize < 1 || conf.AccessLog.BufferSize < 1 || conf.AccessLog.FlushInterval <= 0 {
+		return fmt.Errorf("アクセスログの設定が不正です。")
+	}
+	if err := conf.AccessLog.validate(); err != nil {
+		return err
+	}
+	if conf.Update.BackoffMin <= 0 || conf.Update.BackoffMax < conf.Update.BackoffMin {
+		return fmt.Errorf("backoffの設定が不正です。")
+	}
+	if conf.Update.MaxFailedRatio < 0 || conf.Update.MaxFailedRatio > 1 {
+		return fmt.Errorf("max_failed_ratioは0から1の間で指定してください。")
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsPrefixes CORSを許可するパス、管理APIや静的ファイルは対象外
+var corsPrefixes = []string{"/data/", "/api/"}
+
+// CORSConfig 他オリジンからの取得を許可する設定
+// AllowedOriginsが空の場合は無効
+type CORSConfig struct {
+	// "*"で全てのオリジンを許可する
+	AllowedOrigins []string `json:"allowed_origins"`
+	AllowedMethods []string `json:"allowed_methods"`
+	AllowedHeaders []string `json:"allowed_headers"`
+	ExposedHeaders []string `json:"exposed_headers"`
+	// プリフライトの結果をブラウザがキャッシュする時間
+	MaxAge Duration `json:"max_age"`
+}
+
+func defaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowedMethods: []string{http.MethodGet, http.MethodHead},
+		AllowedHeaders: []string{"Content-Type", HeaderRequestID, HeaderTraceparent},
+		ExposedHeaders: []string{HeaderRequestID, "Retry-After", HeaderSourceCommit, HeaderSourceCommitTime},
+		MaxAge:         Duration(10 * time.Minute),
+	}
+}
+
+func (conf CORSConfig) validate() error {
+	for _, o := range conf.AllowedOrigins {
+		if o != "*" && !strings.HasPrefix(o, "http://") && !strings.HasPrefix(o, "https://") {
+			return fmt.Errorf("CORSのオリジンが不正です。:%s", o)
+		}
+	}
+	if conf.MaxAge < 0 {
+		return fmt.Errorf("CORSのmax_ageが不正です。")
+	}
+	return nil
+}
+
+func corsTarget(p string) bool {
+	for _, prefix := range corsPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cors 対象パスにCORSヘッダを付け、プリフライトに応答する
+func cors(conf CORSConfig) middleware {
+	allowAll := false
+	origins := make(map[string]struct{}, len(conf.AllowedOrigins))
+	for _, o := range conf.AllowedOrigins {
+		if o == "*" {
+			allowAll = true
+		}
+		origins[strings.ToLower(strings.TrimSuffix(o, "/"))] = struct{}{}
+	}
+	methods := make(map[string]struct{}, len(conf.AllowedMethods))
+	for _, m := range conf.AllowedMethods {
+		methods[strings.ToUpper(m)] = struct{}{}
+	}
+	allowMethods := strings.Join(conf.AllowedMethods, ", ")
+	allowHeaders := strings.Join(conf.AllowedHeaders, ", ")
+	exposeHeaders := strings.Join(conf.ExposedHeaders, ", ")
+	maxAge := strconv.FormatInt(int64(time.Duration(conf.MaxAge)/time.Second), 10)
+	return func(h http.Handler) http.Handler {
+		if len(origins) == 0 {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !corsTarget(r.URL.Path) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			// Originの無い応答を共有キャッシュが他オリジンに返さないよう、常に付ける
+			header := w.Header()
+			header.Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			_, ok := origins[strings.ToLower(origin)]
+			if !ok && !allowAll {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if allowAll {
+				header.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				header.Set("Access-Control-Allow-Origin", origin)
+			}
+			reqMethod := r.Header.Get("Access-Control-Request-Method")
+			if r.Method != http.MethodOptions || reqMethod == "" {
+				if exposeHeaders != "" {
+					header.Set("Access-Control-Expose-Headers", exposeHeaders)
+				}
+				h.ServeHTTP(w, r)
+				return
+			}
+			// プリフライト
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+			if _, ok := methods[strings.ToUpper(reqMethod)]; !ok {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			header.Set("Access-Control-Allow-Methods", allowMethods)
+			if allowHeaders != "" {
+				header.Set("Access-Control-Allow-Headers", allowHeaders)
+			}
+			if conf.MaxAge > 0 {
+				header.Set("Access-Control-Max-Age", maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+)
+
+// データ更新の失敗の種類
+const (
+	ErrorKindSource     = "source_unavailable"
+	ErrorKindConversion = "partial_conversion"
+	ErrorKindWrite      = "write_failure"
+)
+
+// SourceError 元データを取得できない
+// 前回までのデータは残っているので配信は続けられる
+type SourceError struct {
+	Err error
+}
+
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("元データを取得できませんでした。:%s", e.Err)
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// ConversionError 変換に失敗したファイルが多すぎて使えない
+type ConversionError struct {
+	Result conversionResult
+}
+
+func (e *ConversionError) Error() string {
+	return fmt.Sprintf("データ変換に失敗したファイルが多すぎます。:%d/%d", e.Result.Failed, e.Result.Files)
+}
+
+// WriteError 変換したデータを書き出せない
+// 書きかけのファイルが残っている可能性がある
+type WriteError struct {
+	Path string
+	Err  error
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("ファイルの書き出しに失敗しました。:%s %s", e.Path, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// errorKind 種類の分からないものは空文字
+func errorKind(err error) string {
+	var se *SourceError
+	var ce *ConversionError
+	var we *WriteError
+	switch {
+	case errors.As(err, &se):
+		return ErrorKindSource
+	case errors.As(err, &ce):
+		return ErrorKindConversion
+	case errors.As(err, &we):
+		return ErrorKindWrite
+	}
+	return ""
+}
+
+// unusable 配信中のデータが壊れているか、使えるデータを作れなかった
+func unusable(err error) bool {
+	switch errorKind(err) {
+	case ErrorKindConversion, ErrorKindWrite:
+		return true
+	}
+	return false
+}
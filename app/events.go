@@ -0,0 +1,145 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	EventHeartbeatDuration = 30 * time.Second
+	EventClientBufferSize  = 16
+	EventRetryMillisecond  = 10000
+)
+
+// dataUpdatedEvent データ更新通知の中身
+type dataUpdatedEvent struct {
+	First  string `json:"first"`
+	Last   string `json:"last"`
+	Commit string `json:"commit,omitempty"`
+}
+
+type serverEvent struct {
+	id   uint64
+	name string
+	data []byte
+}
+
+// eventBroker Server-Sent Eventsの配信管理
+type eventBroker struct {
+	sync.Mutex
+	ctx     context.Context
+	id      uint64
+	clients map[chan serverEvent]struct{}
+}
+
+func newEventBroker(ctx context.Context) *eventBroker {
+	return &eventBroker{
+		ctx:     ctx,
+		clients: make(map[chan serverEvent]struct{}),
+	}
+}
+
+// publish 全クライアントへ配信する
+// 受信が追いつかずバッファが溢れたクライアントは切断する
+func (b *eventBroker) publish(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.id++
+	ev := serverEvent{id: b.id, name: name, data: data}
+	for ch := range b.clients {
+		select {
+		case ch <- ev:
+		default:
+			log.Infow("イベントの受信が遅いクライアントを切断します。")
+			delete(b.clients, ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+func (b *eventBroker) subscribe() chan serverEvent {
+	ch := make(chan serverEvent, EventClientBufferSize)
+	b.Lock()
+	defer b.Unlock()
+	b.clients[ch] = struct{}{}
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan serverEvent) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.clients[ch]; ok {
+		delete(b.clients, ch)
+		close(ch)
+	}
+}
+
+func (b *eventBroker) publishDataUpdated(cr conversionResult, commit string) {
+	err := b.publish("data-updated", dataUpdatedEvent{
+		First:  cr.First,
+		Last:   cr.Last,
+		Commit: commit,
+	})
+	if err != nil {
+		log.Warnw("イベントの配信に失敗しました。", "error", err)
+	}
+}
+
+func (b *eventBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "ストリーミングに対応していません。", http.StatusInternalServerError)
+		return
+	}
+	// 接続し続けるのでサーバ全体のタイムアウトは外す
+	rc := http.NewResponseController(w)
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		log.Debugw("読み込み期限を解除できませんでした。", "error", err)
+	}
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Debugw("書き込み期限を解除できませんでした。", "error", err)
+	}
+	ch := b.subscribe()
+	defer b.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", EventRetryMillisecond)
+	flusher.Flush()
+
+	tc := time.NewTicker(EventHeartbeatDuration)
+	defer tc.Stop()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-r.Context().Done():
+			return
+		case <-tc.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev, ok := <-ch:
+			if !ok {
+				// バッファ溢れで切断された
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.id, ev.name, ev.data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+const (
+	FetcherGoGit  = "go-git"
+	FetcherSystem = "system"
+
+	// GitSparseDir スパースチェックアウトで取り出すフォルダ
+	GitSparseDir = "csse_covid_19_data"
+)
+
+// GitConfig 元データのリポジトリの取得方法
+type GitConfig struct {
+	// file://で始まるローカルのミラーも指定できる
+	URL    string `json:"url"`
+	Branch string `json:"branch"`
+	// go-gitかsystem（gitコマンド）
+	Fetcher string `json:"fetcher"`
+	// systemの場合に使うgitコマンド
+	Command string `json:"command"`
+	// 0の場合は全履歴を取得する
+	Depth int `json:"depth"`
+	// csse_covid_19_dataだけを取り出す（systemのみ）
+	Sparse  bool     `json:"sparse"`
+	Timeout Duration `json:"timeout"`
+}
+
+func defaultGitConfig() GitConfig {
+	return GitConfig{
+		URL:     DataRepoURL,
+		Branch:  "master",
+		Fetcher: FetcherGoGit,
+		Command: "git",
+		Depth:   1,
+		Timeout: Duration(GitTimeoutDuration),
+	}
+}
+
+func (conf GitConfig) validate() error {
+	if conf.URL == "" || conf.Branch == "" {
+		return fmt.Errorf("gitリポジトリのURLとブランチを指定してください。")
+	}
+	switch conf.Fetcher {
+	case FetcherGoGit:
+		if conf.Sparse {
+			return fmt.Errorf("スパースチェックアウトはsystemでのみ使えます。")
+		}
+	case FetcherSystem:
+		if conf.Command == "" {
+			return fmt.Errorf("gitコマンドを指定してください。")
+		}
+	default:
+		return fmt.Errorf("gitの取得方法が不正です。:%s", conf.Fetcher)
+	}
+	if conf.Depth < 0 || conf.Timeout <= 0 {
+		return fmt.Errorf("gitの設定が不正です。")
+	}
+	return nil
+}
+
+// 取得結果
+const (
+	FetchCloned   = "clone"
+	FetchUpdated  = "updated"
+	FetchNoUpdate = "no_update"
+)
+
+// fetcher リポジトリをリモートの状態に合わせる
+// 手元に無ければclone、あればfetchしてhard reset（強制pushされても追従できる）
+type fetcher interface {
+	sync(ctx context.Context, dir string) (string, error)
+}
+
+func newFetcher(conf GitConfig) fetcher {
+	if conf.Fetcher == FetcherSystem {
+		return &systemFetcher{conf: conf}
+	}
+	return &goGitFetcher{conf: conf}
+}
+
+// goGitFetcher go-gitによる取得、gitコマンドが無い環境向け
+// go-gitのスパースチェックアウトは対象外のファイルも書き出してしまい、
+// 消すとhard resetに失敗するので対応しない
+type goGitFetcher struct {
+	conf GitConfig
+}
+
+func (f *goGitFetcher) sync(ctx context.Context, dir string) (string, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return FetchCloned, f.clone(ctx, dir)
+	}
+	return f.update(ctx, dir)
+}
+
+func (f *goGitFetcher) clone(ctx context.Context, dir string) error {
+	if err := checkAndCreateDir(dir); err != nil {
+		return err
+	}
+	branch := plumbing.NewBranchReferenceName(f.conf.Branch)
+	r, err := git.PlainCloneContext(ctx, dir, false, &git.CloneOptions{
+		URL:           f.conf.URL,
+		ReferenceName: branch,
+		SingleBranch:  true,
+		Depth:         f.conf.Depth,
+		NoCheckout:    true,
+		Tags:          git.NoTags,
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	return w.Checkout(&git.CheckoutOptions{Branch: branch, Force: true})
+}
+
+func (f *goGitFetcher) update(ctx context.Context, dir string) (string, error) {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return "", err
+	}
+	remote := plumbing.NewRemoteReferenceName("origin", f.conf.Branch)
+	err = r.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{config.RefSpec("+" + plumbing.NewBranchReferenceName(f.conf.Branch) + ":" + remote)},
+		Depth:      f.conf.Depth,
+		Tags:       git.NoTags,
+		Force:      true,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return "", err
+	}
+	ref, err := r.Reference(remote, true)
+	if err != nil {
+		return "", err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return "", err
+	}
+	if head.Hash() == ref.Hash() {
+		return FetchNoUpdate, nil
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return "", err
+	}
+	err = w.Reset(&git.ResetOptions{Commit: ref.Hash(), Mode: git.HardReset})
+	if err != nil {
+		return "", err
+	}
+	return FetchUpdated, nil
+}
+
+// systemFetcher gitコマンドによる取得
+// 大きなリポジトリではgo-gitより速く、部分clone（--filter）も使える
+type systemFetcher struct {
+	conf GitConfig
+}
+
+func (f *systemFetcher) sync(ctx context.Context, dir string) (string, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return FetchCloned, f.clone(ctx, dir)
+	}
+	return f.update(ctx, dir)
+}
+
+func (f *systemFetcher) clone(ctx context.Context, dir string) error {
+	if err := checkAndCreateDir(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	args := []string{"clone", "--single-branch", "--no-tags", "--branch", f.conf.Branch}
+	if f.conf.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(f.conf.Depth))
+	}
+	if f.conf.Sparse {
+		args = append(args, "--sparse", "--filter=blob:none")
+	}
+	args = append(args, f.conf.URL, dir)
+	if _, err := f.git(ctx, "", args...); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	return f.sparse(ctx, dir)
+}
+
+func (f *systemFetcher) update(ctx context.Context, dir string) (string, error) {
+	remote := "refs/remotes/origin/" + f.conf.Branch
+	args := []string{"fetch", "--no-tags", "--force"}
+	if f.conf.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(f.conf.Depth))
+	}
+	args = append(args, "origin", "+refs/heads/"+f.conf.Branch+":"+remote)
+	if _, err := f.git(ctx, dir, args...); err != nil {
+		return "", err
+	}
+	// 設定の変更に合わせる
+	if err := f.sparse(ctx, dir); err != nil {
+		return "", err
+	}
+	head, err := f.git(ctx, dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	target, err := f.git(ctx, dir, "rev-parse", remote)
+	if err != nil {
+		return "", err
+	}
+	if head == target {
+		return FetchNoUpdate, nil
+	}
+	if _, err := f.git(ctx, dir, "reset", "--hard", target); err != nil {
+		return "", err
+	}
+	return FetchUpdated, nil
+}
+
+func (f *systemFetcher) sparse(ctx context.Context, dir string) error {
+	var err error
+	if f.conf.Sparse {
+		_, err = f.git(ctx, dir, "sparse-checkout", "set", GitSparseDir)
+	} else {
+		_, err = f.git(ctx, dir, "sparse-checkout", "disable")
+	}
+	return err
+}
+
+// git 標準出力の前後の空白を除いて返す
+func (f *systemFetcher) git(ctx context.Context, dir string, args ...string) (string, error) {
+	sub := args[0]
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	cmd := exec.CommandContext(ctx, f.conf.Command, args...)
+	// 認証の入力待ちで止まらないようにする
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.WaitDelay = 10 * time.Second
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", sub, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,161 @@
+package app
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const testDataFile = "csse_covid_19_data/csse_covid_19_daily_reports/01-22-2020.csv"
+
+// testOrigin file://で取得できる元データのリポジトリ
+type testOrigin struct {
+	t   *testing.T
+	dir string
+	r   *git.Repository
+}
+
+func newTestOrigin(t *testing.T) *testOrigin {
+	t.Helper()
+	dir := t.TempDir()
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 既定のブランチ名に左右されないようにする
+	head := plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName("master"))
+	if err := r.Storer.SetReference(head); err != nil {
+		t.Fatal(err)
+	}
+	return &testOrigin{t: t, dir: dir, r: r}
+}
+
+func (o *testOrigin) url() string {
+	return "file://" + filepath.ToSlash(o.dir)
+}
+
+// commit parentsを指定すると履歴を書き換えたことになる（強制push相当）
+func (o *testOrigin) commit(content string, parents ...plumbing.Hash) plumbing.Hash {
+	o.t.Helper()
+	p := filepath.Join(o.dir, filepath.FromSlash(testDataFile))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		o.t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		o.t.Fatal(err)
+	}
+	w, err := o.r.Worktree()
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	if _, err := w.Add(testDataFile); err != nil {
+		o.t.Fatal(err)
+	}
+	h, err := w.Commit(content, &git.CommitOptions{
+		Author:  &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		Parents: parents,
+	})
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	return h
+}
+
+func testHead(t *testing.T, dir string) plumbing.Hash {
+	t.Helper()
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := r.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref.Hash()
+}
+
+func testContent(t *testing.T, dir string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(testDataFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestFetcherSync(t *testing.T) {
+	tests := []struct {
+		name    string
+		fetcher string
+		depth   int
+		sparse  bool
+	}{
+		{"go-git", FetcherGoGit, 1, false},
+		{"go-git full", FetcherGoGit, 0, false},
+		{"system", FetcherSystem, 1, false},
+		{"system sparse", FetcherSystem, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := defaultGitConfig()
+			conf.Fetcher = tt.fetcher
+			conf.Depth = tt.depth
+			conf.Sparse = tt.sparse
+			// go-gitもfile://の取得にはgit-upload-packを実行するので、どちらもgitコマンドが要る
+			if _, err := exec.LookPath(conf.Command); err != nil {
+				t.Skip("gitコマンドがありません。")
+			}
+			origin := newTestOrigin(t)
+			first := origin.commit("first")
+			second := origin.commit("second", first)
+
+			conf.URL = origin.url()
+			if err := conf.validate(); err != nil {
+				t.Fatal(err)
+			}
+			f := newFetcher(conf)
+			ctx := context.Background()
+			dir := filepath.Join(t.TempDir(), "COVID-19")
+
+			res, err := f.sync(ctx, dir)
+			if err != nil || res != FetchCloned {
+				t.Fatalf("clone: %s %v", res, err)
+			}
+			if h := testHead(t, dir); h != second {
+				t.Fatalf("clone: head = %s, want %s", h, second)
+			}
+			if c := testContent(t, dir); c != "second" {
+				t.Fatalf("clone: content = %q", c)
+			}
+
+			res, err = f.sync(ctx, dir)
+			if err != nil || res != FetchNoUpdate {
+				t.Fatalf("no update: %s %v", res, err)
+			}
+
+			// 強制pushで2つ目のコミットを消し、手元のファイルも書き換えておく
+			rewritten := origin.commit("rewritten", first)
+			p := filepath.Join(dir, filepath.FromSlash(testDataFile))
+			if err := os.WriteFile(p, []byte("local"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			res, err = f.sync(ctx, dir)
+			if err != nil || res != FetchUpdated {
+				t.Fatalf("force push: %s %v", res, err)
+			}
+			if h := testHead(t, dir); h != rewritten {
+				t.Fatalf("force push: head = %s, want %s", h, rewritten)
+			}
+			if c := testContent(t, dir); c != "rewritten" {
+				t.Fatalf("force push: content = %q", c)
+			}
+		})
+	}
+}
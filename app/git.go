@@ -2,79 +2,38 @@ package app
 
 import (
 	"context"
-	"os"
+	"time"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/storage/memory"
 )
 
-func updateGitData(ctx context.Context) error {
-	clone, err := checkGit(ctx)
+func updateGitData(ctx context.Context, conf GitConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(conf.Timeout))
+	defer cancel()
+	res, err := newFetcher(conf).sync(ctx, GitPath)
 	if err != nil {
+		stats.addGitUpdate("failure")
+		log.Warnw("gitリポジトリの取得に失敗", "error", err, "url", conf.URL, "fetcher", conf.Fetcher)
 		return err
-	} else if clone {
-		return nil
 	}
-	err = updateGit(ctx, GitPath)
-	if err == git.NoErrAlreadyUpToDate {
+	stats.addGitUpdate(res)
+	switch res {
+	case FetchCloned:
+		log.Infow("gitリポジトリをcloneしました", "path", conf.URL)
+	case FetchNoUpdate:
 		return errNoUpdate
-	} else if err != nil {
-		return err
 	}
 	return nil
 }
 
-func checkGit(ctx context.Context) (bool, error) {
-	_, err := os.Stat(GitPath)
-	if err != nil {
-		err = cloneGit(ctx, GitPath, DataRepoURL)
-		if err != nil {
-			log.Warnw("gitリポジトリのcloneに失敗", "error", err)
-		} else {
-			log.Infow("gitリポジトリをcloneしました", "path", DataRepoURL)
-			return true, nil
-		}
-	}
-	return false, err
-}
-
-func cloneGit(ctx context.Context, p, url string) error {
-	if err := checkAndCreateDir(p); err != nil {
-		return err
-	}
-	r, err := git.PlainCloneContext(ctx, p, false, &git.CloneOptions{
-		URL:   url,
-		Depth: 1,
+// checkGitRemote 元データのリポジトリに接続できるか確認する
+func checkGitRemote(ctx context.Context, url string) error {
+	rem := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{url},
 	})
-	if err != nil {
-		return err
-	}
-	_, err = r.Head()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func updateGit(ctx context.Context, p string) error {
-	r, err := git.PlainOpen(p)
-	if err != nil {
-		return err
-	}
-	w, err := r.Worktree()
-	if err != nil {
-		return err
-	}
-	err = w.Checkout(&git.CheckoutOptions{Force: true})
-	if err != nil {
-		return err
-	}
-	err = w.PullContext(ctx, &git.PullOptions{RemoteName: "origin"})
-	if err != nil {
-		return err
-	}
-	_, err = r.Head()
-	if err != nil {
-		return err
-	}
-	return nil
+	_, err := rem.ListContext(ctx, &git.ListOptions{})
+	return err
 }
@@ -4,41 +4,96 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/tanaton/covid-19-chart/app/compact"
 )
 
 type GetMonitoringHandler struct {
-	ch <-chan resultMonitor
+	ch <-chan monitorHistory
+}
+
+// monitorSeries window指定時のレスポンス
+type monitorSeries struct {
+	Window string
+	Step   string
+	Points []monitorPoint
 }
 
-func (h *GetMonitoringHandler) getResultMonitor(ctx context.Context) (resultMonitor, error) {
-	var res resultMonitor
+func (h *GetMonitoringHandler) getResultMonitor(ctx context.Context) (monitorHistory, error) {
+	var res monitorHistory
+	ctx, sp := startSpan(ctx, "api.monitor.query", "internal")
+	defer sp.end()
 	ctx, cancel := context.WithTimeout(ctx, time.Second*3)
 	defer cancel()
 	select {
 	case <-ctx.Done():
-		return res, errors.New("timeout")
+		err := errors.New("timeout")
+		sp.setError(err)
+		return res, err
 	case res = <-h.ch:
-		log.Debugw("受信！ getResultMonitor", "data", res)
+		requestLogger(ctx).Debugw("受信！ getResultMonitor", "data", res.latest)
 	}
 	return res, nil
 }
 
 func (h *GetMonitoringHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	res, err := h.getResultMonitor(r.Context())
+	var window, step time.Duration
+	q := r.URL.Query()
+	if ws := q.Get("window"); ws != "" {
+		var err error
+		window, step, err = parseMonitorWindow(ws, q.Get("step"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	hist, err := h.getResultMonitor(r.Context())
 	if err == nil {
+		var v interface{} = hist.latest
+		if window > 0 {
+			v = monitorSeries{
+				Window: window.String(),
+				Step:   step.String(),
+				Points: hist.series(time.Now(), window, step),
+			}
+		}
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		err := json.NewEncoder(w).Encode(res)
+		err := json.NewEncoder(w).Encode(v)
 		if err != nil {
-			log.Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
+			requestLogger(r.Context()).Warnw("JSON出力に失敗しました。", "error", err, "path", r.URL.Path)
 		}
 	} else {
 		http.Error(w, "データ取得に失敗しました。", http.StatusInternalServerError)
 	}
 }
 
+// parseMonitorWindow windowとstepの解釈
+// stepは1分単位で、省略時は1分
+func parseMonitorWindow(ws, ss string) (time.Duration, time.Duration, error) {
+	window, err := time.ParseDuration(ws)
+	if err != nil || window <= 0 {
+		return 0, 0, fmt.Errorf("windowが不正です。:%s", ws)
+	}
+	step := time.Minute
+	if ss != "" {
+		step, err = time.ParseDuration(ss)
+		if err != nil || step < time.Minute || step%time.Minute != 0 {
+			return 0, 0, fmt.Errorf("stepが不正です。:%s", ss)
+		}
+	}
+	if step > window {
+		return 0, 0, fmt.Errorf("stepがwindowより大きいです。")
+	}
+	return window, step, nil
+}
+
 type alias interface {
 	getPath() string
 	setPath(p string)
@@ -64,3 +119,50 @@ func (h *aliasHandler) setPath(p string) {
 func (h *aliasHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, h.getPath())
 }
+
+// summaryHandler Acceptヘッダを見てsummaryの形式を切り替える
+type summaryHandler struct{}
+
+func (h *summaryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept")
+	p := SummaryDataPath
+	switch negotiateSummary(r.Header.Get("Accept")) {
+	case compact.MediaTypeJSON:
+		w.Header().Set("Content-Type", compact.MediaTypeJSON)
+		p = CompactJSONPath
+	case compact.MediaTypeBinary:
+		w.Header().Set("Content-Type", compact.MediaTypeBinary)
+		p = CompactBinaryPath
+	}
+	http.ServeFile(w, r, p)
+}
+
+// negotiateSummary Acceptヘッダの重み（q）が最も大きいcompact形式を返す
+// 通常のJSON（application/json、*/*等）の方が重い場合やq=0の場合は空文字
+// 重みが同じ場合は先に指定されたものを使う
+func negotiateSummary(accept string) string {
+	best := ""
+	bestq := 0.0
+	for _, it := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(it))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q <= bestq {
+			continue
+		}
+		switch mt {
+		case compact.MediaTypeJSON, compact.MediaTypeBinary:
+			best, bestq = mt, q
+		case "application/json", "application/*", "*/*":
+			best, bestq = "", q
+		}
+	}
+	return best
+}
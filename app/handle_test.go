@@ -0,0 +1,46 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/tanaton/covid-19-chart/app/compact"
+)
+
+func TestNegotiateSummary(t *testing.T) {
+	const (
+		cj = compact.MediaTypeJSON
+		cb = compact.MediaTypeBinary
+	)
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"*/*", ""},
+		{"text/html", ""},
+		{cb, cb},
+		{cj, cj},
+		{"application/json", ""},
+		// 重みが最も大きいものを選ぶ
+		{"*/*;q=0.9, " + cb, cb},
+		{cb + ";q=0.5, application/json", ""},
+		{"application/json;q=0.5, " + cj + ";q=0.8", cj},
+		{"application/*;q=0.9, " + cb + ";q=0.95", cb},
+		// q=0は受け付けないという意味
+		{cb + ";q=0", ""},
+		{cb + ";q=0, " + cj + ";q=0.1", cj},
+		// 同じ重みなら先に書かれた方
+		{cj + ", " + cb, cj},
+		{cb + ";q=0.7, " + cj + ";q=0.7", cb},
+		{"application/json, " + cb, ""},
+		// 壊れた指定は無視する
+		{cb + ";q=x", ""},
+		{cb + ";q=x, " + cj + ";q=0.1", cj},
+		{"garbage;;, " + cb, cb},
+	}
+	for _, tt := range tests {
+		if got := negotiateSummary(tt.accept); got != tt.want {
+			t.Errorf("negotiateSummary(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version ビルド時に -ldflags "-X github.com/tanaton/covid-19-chart/app.Version=..." で設定する
+var Version = ""
+
+var startTime = time.Now()
+
+const GitCheckTimeoutDuration = 10 * time.Second
+
+func version() string {
+	if Version != "" {
+		return Version
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, it := range bi.Settings {
+		if it.Key == "vcs.revision" {
+			return it.Value
+		}
+	}
+	return bi.Main.Version
+}
+
+// healthChecker /healthz、/readyz、/api/v1/status
+type healthChecker struct {
+	app *application
+	sync.Mutex
+	gitChecked time.Time
+	gitErr     error
+}
+
+type healthStatus struct {
+	Version   string       `json:"version"`
+	GoVersion string       `json:"go_version"`
+	Start     time.Time    `json:"start"`
+	Uptime    string       `json:"uptime"`
+	Ready     bool         `json:"ready"`
+	Reasons   []string     `json:"reasons,omitempty"`
+	Data      dataStatus   `json:"data"`
+	Update    updateStatus `json:"update"`
+	// データ更新の実行中のみ
+	Progress *updateProgress `json:"progress,omitempty"`
+}
+
+type dataStatus struct {
+	Generation *time.Time `json:"generation,omitempty"`
+	Age        string     `json:"age,omitempty"`
+	Commit     string     `json:"commit,omitempty"`
+	// 元データのコミットの日時とメッセージ
+	Source *sourceCommit `json:"source,omitempty"`
+}
+
+func newHealthChecker(app *application) *healthChecker {
+	return &healthChecker{app: app}
+}
+
+// gitReachable 毎回接続すると重いので結果をキャッシュする
+func (hc *healthChecker) gitReachable(ctx context.Context) error {
+	hc.Lock()
+	defer hc.Unlock()
+	if !hc.gitChecked.IsZero() && time.Since(hc.gitChecked) < time.Duration(hc.app.config().Health.GitCheckInterval) {
+		return hc.gitErr
+	}
+	ctx, cancel := context.WithTimeout(ctx, GitCheckTimeoutDuration)
+	defer cancel()
+	hc.gitErr = checkGitRemote(ctx, hc.app.config().Git.URL)
+	hc.gitChecked = time.Now()
+	return hc.gitErr
+}
+
+// ready 準備できていない理由を返す
+func (hc *healthChecker) ready(ctx context.Context, now time.Time) []string {
+	reasons := []string{}
+	if _, err := os.Stat(SummaryDataPath); err != nil {
+		reasons = append(reasons, "summary.jsonがありません。")
+	}
+	gen := stats.dataGeneration()
+	if gen.IsZero() {
+		reasons = append(reasons, "データが変換されていません。")
+	} else if max := time.Duration(hc.app.config().Health.MaxDataAge); max > 0 && now.Sub(gen) > max {
+		reasons = append(reasons, fmt.Sprintf("データが古すぎます。:%s", now.Sub(gen).Truncate(time.Second)))
+	}
+	if last := hc.app.status.get(); last.Kind == ErrorKindConversion || last.Kind == ErrorKindWrite {
+		reasons = append(reasons, fmt.Sprintf("直近のデータ更新で使えるデータを作れませんでした。:%s", last.Error))
+	}
+	if hc.app.config().Health.RequireGit {
+		if err := hc.gitReachable(ctx); err != nil {
+			reasons = append(reasons, fmt.Sprintf("gitリポジトリに接続できません。:%s", err))
+		}
+	}
+	return reasons
+}
+
+func (hc *healthChecker) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (hc *healthChecker) readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	reasons := hc.ready(r.Context(), time.Now())
+	if len(reasons) > 0 {
+		writeJSON(w, r, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "reasons": reasons})
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (hc *healthChecker) status(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	reasons := hc.ready(r.Context(), now)
+	st := healthStatus{
+		Version:   version(),
+		GoVersion: runtime.Version(),
+		Start:     startTime,
+		Uptime:    now.Sub(startTime).Truncate(time.Second).String(),
+		Ready:     len(reasons) == 0,
+		Reasons:   reasons,
+		Update:    hc.app.status.get(),
+		Progress:  hc.app.status.progress(),
+	}
+	if gen := stats.dataGeneration(); !gen.IsZero() {
+		st.Data.Generation = &gen
+		st.Data.Age = now.Sub(gen).Truncate(time.Second).String()
+	}
+	if m := provenance.Load(); m != nil {
+		st.Data.Commit = m.Source.Hash
+		st.Data.Source = &m.Source
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, r, http.StatusOK, st)
+}
+
+// DataLoadingRetryAfter データ準備中に返すRetry-Afterの秒数
+const DataLoadingRetryAfter = 10
+
+// dataLoading 一度もデータを変換できていない間は/data/に503を返す
+// 前回までのデータが残っていればそれを配信する
+func (hc *healthChecker) dataLoading(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/data/") || !stats.dataGeneration().IsZero() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		last := hc.app.status.get()
+		body := map[string]interface{}{"status": "loading"}
+		if pr := hc.app.status.progress(); pr != nil {
+			body["progress"] = pr
+		} else if last.End != nil && last.Error != "" {
+			// 初回の更新に失敗していて、バックオフ後の再試行を待っている
+			body["status"] = "unavailable"
+			body["error"] = last.Error
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Retry-After", strconv.Itoa(DataLoadingRetryAfter))
+		writeJSON(w, r, http.StatusServiceUnavailable, body)
+	})
+}
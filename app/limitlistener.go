@@ -0,0 +1,49 @@
+package app
+
+import (
+	"net"
+	"sync"
+)
+
+// limitListener 同時接続数の上限を超えた接続はすぐに閉じて数える
+// netutil.LimitListenerと違い、上限に達してもAcceptを止めない
+type limitListener struct {
+	net.Listener
+	sem  chan struct{}
+	addr string
+}
+
+func newLimitListener(l net.Listener, n int, addr string) net.Listener {
+	if n <= 0 {
+		return l
+	}
+	return &limitListener{Listener: l, sem: make(chan struct{}, n), addr: addr}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.sem <- struct{}{}:
+			return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+		default:
+			c.Close()
+			stats.addConnectionRejected(l.addr)
+		}
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
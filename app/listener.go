@@ -0,0 +1,240 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ListenerConfig 待ち受けの設定
+// TLSとACMEの両方が無い場合は平文のHTTP
+type ListenerConfig struct {
+	Addr string `json:"addr"`
+	// 同時接続数の上限、0の場合はServer.MaxConnectionsに従う
+	MaxConnections int            `json:"max_connections"`
+	TLS            *TLSFileConfig `json:"tls,omitempty"`
+	ACME           *ACMEConfig    `json:"acme,omitempty"`
+}
+
+// TLSFileConfig 証明書ファイル
+type TLSFileConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// ACMEConfig Let's Encrypt等からの証明書自動取得
+type ACMEConfig struct {
+	Hosts []string `json:"hosts"`
+	// 空の場合はautocert.NewListenerと同じ場所
+	CacheDir string `json:"cache_dir"`
+	// 空の場合はLet's Encryptの本番環境
+	DirectoryURL string `json:"directory_url"`
+	Email        string `json:"email"`
+	// ACMEサーバのTLS証明書を検証するためのCA（Pebble等のテスト用）
+	CACert string `json:"ca_cert"`
+}
+
+func defaultListeners() []ListenerConfig {
+	return []ListenerConfig{
+		{Addr: ":8080"},
+		{Addr: ":443", ACME: &ACMEConfig{Hosts: []string{RootDomain}}},
+	}
+}
+
+func (conf ListenerConfig) validate() error {
+	if conf.Addr == "" {
+		return fmt.Errorf("待ち受けアドレスがありません。")
+	}
+	if conf.TLS != nil && conf.ACME != nil {
+		return fmt.Errorf("TLSとACMEは同時に指定できません。:%s", conf.Addr)
+	}
+	if conf.TLS != nil && (conf.TLS.Cert == "" || conf.TLS.Key == "") {
+		return fmt.Errorf("証明書ファイルの指定が不足しています。:%s", conf.Addr)
+	}
+	if conf.MaxConnections < 0 {
+		return fmt.Errorf("同時接続数の上限が不正です。:%s", conf.Addr)
+	}
+	if conf.ACME != nil && len(conf.ACME.Hosts) == 0 {
+		return fmt.Errorf("ACMEのホスト名がありません。:%s", conf.Addr)
+	}
+	// 起動してから気付いても待ち受けられないので読めるか確かめておく
+	if conf.TLS != nil {
+		if _, err := tls.LoadX509KeyPair(conf.TLS.Cert, conf.TLS.Key); err != nil {
+			return fmt.Errorf("証明書ファイルを読み込めませんでした。:%s %w", conf.Addr, err)
+		}
+	}
+	if conf.ACME != nil && conf.ACME.CACert != "" {
+		if _, err := loadCertPool(conf.ACME.CACert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServerConfig 全ての待ち受けに共通するサーバの設定
+// drain_timeout以外は0の項目を制限しない
+type ServerConfig struct {
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	ReadTimeout       Duration `json:"read_timeout"`
+	WriteTimeout      Duration `json:"write_timeout"`
+	IdleTimeout       Duration `json:"idle_timeout"`
+	MaxHeaderBytes    int      `json:"max_header_bytes"`
+	MaxConnections    int      `json:"max_connections"`
+	// 終了時に処理中のリクエストを待つ時間、過ぎたら強制的に切断する
+	DrainTimeout Duration `json:"drain_timeout"`
+}
+
+func defaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ReadHeaderTimeout: Duration(10 * time.Second),
+		ReadTimeout:       Duration(30 * time.Second),
+		WriteTimeout:      Duration(2 * time.Minute),
+		IdleTimeout:       Duration(2 * time.Minute),
+		MaxHeaderBytes:    64 * 1024,
+		MaxConnections:    1024,
+		DrainTimeout:      Duration(10 * time.Second),
+	}
+}
+
+func (conf ServerConfig) validate() error {
+	if conf.ReadHeaderTimeout < 0 || conf.ReadTimeout < 0 || conf.WriteTimeout < 0 || conf.IdleTimeout < 0 {
+		return fmt.Errorf("サーバのタイムアウト設定が不正です。")
+	}
+	if conf.DrainTimeout <= 0 {
+		return fmt.Errorf("drain_timeoutは0より大きくしてください。")
+	}
+	if conf.MaxHeaderBytes < 0 || conf.MaxConnections < 0 {
+		return fmt.Errorf("サーバの上限設定が不正です。")
+	}
+	return nil
+}
+
+// newServerItem 設定からサーバを用意する
+func newServerItem(conf ListenerConfig, sc ServerConfig, h http.Handler) (serverItem, error) {
+	s := &http.Server{
+		Addr:              conf.Addr,
+		Handler:           h,
+		ReadHeaderTimeout: time.Duration(sc.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(sc.ReadTimeout),
+		WriteTimeout:      time.Duration(sc.WriteTimeout),
+		IdleTimeout:       time.Duration(sc.IdleTimeout),
+		MaxHeaderBytes:    sc.MaxHeaderBytes,
+	}
+	switch {
+	case conf.TLS != nil:
+		cert, err := tls.LoadX509KeyPair(conf.TLS.Cert, conf.TLS.Key)
+		if err != nil {
+			return serverItem{}, err
+		}
+		s.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	case conf.ACME != nil:
+		m, err := newACMEManager(*conf.ACME)
+		if err != nil {
+			return serverItem{}, err
+		}
+		s.TLSConfig = m.TLSConfig()
+	default:
+		return serverItem{
+			s: s,
+			f: func(s *http.Server, ln net.Listener) error {
+				return s.Serve(ln)
+			},
+			conf: conf,
+			sc:   sc,
+		}, nil
+	}
+	return serverItem{
+		s: s,
+		f: func(s *http.Server, ln net.Listener) error {
+			return s.ServeTLS(ln, "", "")
+		},
+		conf: conf,
+		sc:   sc,
+	}, nil
+}
+
+// bind 待ち受けを開く
+// 起動前に呼んでおけば、使用中のポート等で失敗した場合に元の状態のまま諦められる
+func (srv *serverItem) bind() error {
+	ln, err := net.Listen("tcp", srv.s.Addr)
+	if err != nil {
+		return err
+	}
+	maxconn := srv.conf.MaxConnections
+	if maxconn == 0 {
+		maxconn = srv.sc.MaxConnections
+	}
+	srv.ln = newLimitListener(ln, maxconn, srv.s.Addr)
+	return nil
+}
+
+// unbind 起動しなかった待ち受けを閉じる
+func unbind(sl []serverItem) {
+	for _, srv := range sl {
+		if srv.ln != nil {
+			srv.ln.Close()
+		}
+	}
+}
+
+func newACMEManager(conf ACMEConfig) (*autocert.Manager, error) {
+	dir := conf.CacheDir
+	if dir == "" {
+		dir = autocertCacheDir()
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(dir),
+		HostPolicy: autocert.HostWhitelist(conf.Hosts...),
+		Email:      conf.Email,
+	}
+	if conf.DirectoryURL != "" || conf.CACert != "" {
+		client := &acme.Client{DirectoryURL: conf.DirectoryURL}
+		if conf.CACert != "" {
+			pool, err := loadCertPool(conf.CACert)
+			if err != nil {
+				return nil, err
+			}
+			client.HTTPClient = &http.Client{
+				Transport: &http.Transport{
+					Proxy:           http.ProxyFromEnvironment,
+					TLSClientConfig: &tls.Config{RootCAs: pool},
+				},
+			}
+		}
+		m.Client = client
+	}
+	return m, nil
+}
+
+func loadCertPool(p string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA証明書を読み込めませんでした。:%s", p)
+	}
+	return pool, nil
+}
+
+// autocertCacheDir autocert.NewListenerの既定と同じ場所
+func autocertCacheDir() string {
+	const base = "golang-autocert"
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, base)
+	}
+	return filepath.Join(os.TempDir(), base)
+}
@@ -0,0 +1,318 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheusのテキスト形式で出力する簡易メトリクス
+// 外部ライブラリやPrometheusサーバが無くても/metricsをcurlすれば確認できる
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type requestKey struct {
+	route  string
+	status string
+}
+
+type metrics struct {
+	sync.Mutex
+	requests     map[requestKey]uint64
+	bytes        map[string]uint64
+	latency      map[string]*histogram
+	rowsParsed   uint64
+	rowsRejected uint64
+	conversion   time.Duration
+	generation   time.Time
+	gitUpdates   map[string]uint64
+	logDropped   uint64
+	connRejected map[string]uint64
+	rateLimited  map[string]uint64
+	rateClients  map[string]uint64
+}
+
+var stats = newMetrics()
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:     make(map[requestKey]uint64),
+		bytes:        make(map[string]uint64),
+		latency:      make(map[string]*histogram),
+		gitUpdates:   make(map[string]uint64),
+		connRejected: make(map[string]uint64),
+		rateLimited:  make(map[string]uint64),
+		rateClients:  make(map[string]uint64),
+	}
+}
+
+// routeGroup URIを集計用のグループに分類する
+func routeGroup(uri string) string {
+	switch {
+	case strings.HasPrefix(uri, "/api/"):
+		return "api"
+	case strings.HasPrefix(uri, "/data/"):
+		return "data"
+	case strings.HasPrefix(uri, "/admin/"):
+		return "admin"
+	case uri == "/metrics":
+		return "metrics"
+	case uri == "/healthz" || uri == "/readyz":
+		return "health"
+	}
+	return "static"
+}
+
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "other"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+func (m *metrics) observeRequest(ri responseInfo) {
+	route := routeGroup(ri.path)
+	m.Lock()
+	defer m.Unlock()
+	m.requests[requestKey{route: route, status: statusClass(ri.status)}]++
+	m.bytes[route] += uint64(ri.size)
+	h, ok := m.latency[route]
+	if !ok {
+		h = newHistogram()
+		m.latency[route] = h
+	}
+	h.observe(ri.end.Sub(ri.start).Seconds())
+}
+
+func (m *metrics) addRows(parsed, rejected uint64) {
+	m.Lock()
+	defer m.Unlock()
+	m.rowsParsed += parsed
+	m.rowsRejected += rejected
+}
+
+func (m *metrics) rows() (uint64, uint64) {
+	m.Lock()
+	defer m.Unlock()
+	return m.rowsParsed, m.rowsRejected
+}
+
+func (m *metrics) setConversion(d time.Duration, t time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	m.conversion = d
+	m.generation = t
+}
+
+func (m *metrics) setGeneration(t time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	m.generation = t
+}
+
+func (m *metrics) dataGeneration() time.Time {
+	m.Lock()
+	defer m.Unlock()
+	return m.generation
+}
+
+func (m *metrics) addAccessLogDropped() {
+	m.Lock()
+	defer m.Unlock()
+	m.logDropped++
+}
+
+func (m *metrics) addConnectionRejected(addr string) {
+	m.Lock()
+	defer m.Unlock()
+	m.connRejected[addr]++
+}
+
+// connectionRejected 全ての待ち受けの合計
+func (m *metrics) connectionRejected() uint64 {
+	m.Lock()
+	defer m.Unlock()
+	var n uint64
+	for _, v := range m.connRejected {
+		n += v
+	}
+	return n
+}
+
+func (m *metrics) addRateLimited(prefix string) {
+	m.Lock()
+	defer m.Unlock()
+	m.rateLimited[prefix]++
+}
+
+// rateLimitedTotal 全てのルールの合計
+func (m *metrics) rateLimitedTotal() uint64 {
+	m.Lock()
+	defer m.Unlock()
+	var n uint64
+	for _, v := range m.rateLimited {
+		n += v
+	}
+	return n
+}
+
+func (m *metrics) setRateLimitClients(prefix string, n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.rateClients[prefix] = uint64(n)
+}
+
+func (m *metrics) accessLogDropped() uint64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.logDropped
+}
+
+// addGitUpdate resultはclone、updated、no_update、failureのいずれか
+func (m *metrics) addGitUpdate(result string) {
+	m.Lock()
+	defer m.Unlock()
+	m.gitUpdates[result]++
+}
+
+// write 遅いクライアントへの書き込み中にロックを持たないよう、組み立ててから書き出す
+// ロックは全てのリクエストの集計と共有している
+func (m *metrics) write(w io.Writer, now time.Time) error {
+	var buf bytes.Buffer
+	m.render(&buf, now)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func (m *metrics) render(bw *bytes.Buffer, now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+
+	header(bw, "covid19chart_http_requests_total", "counter", "HTTPリクエスト数")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		fmt.Fprintf(bw, "covid19chart_http_requests_total{route=%q,status=%q} %d\n", k.route, k.status, m.requests[k])
+	}
+
+	header(bw, "covid19chart_http_response_bytes_total", "counter", "送信したレスポンスのバイト数")
+	for _, route := range sortedKeys(m.bytes) {
+		fmt.Fprintf(bw, "covid19chart_http_response_bytes_total{route=%q} %d\n", route, m.bytes[route])
+	}
+
+	header(bw, "covid19chart_http_response_seconds", "histogram", "レスポンス時間")
+	routes := make([]string, 0, len(m.latency))
+	for route := range m.latency {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		h := m.latency[route]
+		for i, b := range latencyBuckets {
+			fmt.Fprintf(bw, "covid19chart_http_response_seconds_bucket{route=%q,le=%q} %d\n", route, formatFloat(b), h.counts[i])
+		}
+		fmt.Fprintf(bw, "covid19chart_http_response_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, h.count)
+		fmt.Fprintf(bw, "covid19chart_http_response_seconds_sum{route=%q} %s\n", route, formatFloat(h.sum))
+		fmt.Fprintf(bw, "covid19chart_http_response_seconds_count{route=%q} %d\n", route, h.count)
+	}
+
+	header(bw, "covid19chart_access_log_dropped_total", "counter", "キュー溢れで捨てたアクセスログの件数")
+	fmt.Fprintf(bw, "covid19chart_access_log_dropped_total %d\n", m.logDropped)
+
+	header(bw, "covid19chart_connections_rejected_total", "counter", "同時接続数の上限で拒否した接続数")
+	for _, addr := range sortedKeys(m.connRejected) {
+		fmt.Fprintf(bw, "covid19chart_connections_rejected_total{listener=%q} %d\n", addr, m.connRejected[addr])
+	}
+
+	header(bw, "covid19chart_rate_limited_total", "counter", "レート制限で拒否したリクエスト数")
+	for _, prefix := range sortedKeys(m.rateLimited) {
+		fmt.Fprintf(bw, "covid19chart_rate_limited_total{prefix=%q} %d\n", prefix, m.rateLimited[prefix])
+	}
+	header(bw, "covid19chart_rate_limit_clients", "gauge", "レート制限で追跡中のクライアント数")
+	for _, prefix := range sortedKeys(m.rateClients) {
+		fmt.Fprintf(bw, "covid19chart_rate_limit_clients{prefix=%q} %d\n", prefix, m.rateClients[prefix])
+	}
+
+	header(bw, "covid19chart_data_generation_timestamp_seconds", "gauge", "変換済みデータの生成時刻")
+	if !m.generation.IsZero() {
+		fmt.Fprintf(bw, "covid19chart_data_generation_timestamp_seconds %d\n", m.generation.Unix())
+	}
+	header(bw, "covid19chart_data_generation_age_seconds", "gauge", "変換済みデータの経過時間")
+	if !m.generation.IsZero() {
+		fmt.Fprintf(bw, "covid19chart_data_generation_age_seconds %s\n", formatFloat(now.Sub(m.generation).Seconds()))
+	}
+
+	header(bw, "covid19chart_conversion_duration_seconds", "gauge", "直近のデータ変換にかかった時間")
+	fmt.Fprintf(bw, "covid19chart_conversion_duration_seconds %s\n", formatFloat(m.conversion.Seconds()))
+
+	header(bw, "covid19chart_csv_rows_parsed_total", "counter", "読み込んだCSVの行数")
+	fmt.Fprintf(bw, "covid19chart_csv_rows_parsed_total %d\n", m.rowsParsed)
+	header(bw, "covid19chart_csv_rows_rejected_total", "counter", "読み捨てたCSVの行数")
+	fmt.Fprintf(bw, "covid19chart_csv_rows_rejected_total %d\n", m.rowsRejected)
+
+	header(bw, "covid19chart_git_updates_total", "counter", "gitリポジトリの更新結果")
+	for _, result := range sortedKeys(m.gitUpdates) {
+		fmt.Fprintf(bw, "covid19chart_git_updates_total{result=%q} %d\n", result, m.gitUpdates[result])
+	}
+}
+
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// MetricsHandler /metrics
+type MetricsHandler struct{}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := stats.write(w, time.Now()); err != nil {
+		requestLogger(r.Context()).Warnw("メトリクスの出力に失敗しました。", "error", err, "path", r.URL.Path)
+	}
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	m := newMetrics()
+	m.observeRequest(responseInfo{path: "/data/daily_reports/summary.json", status: 200, size: 100, start: now, end: now.Add(20 * time.Millisecond)})
+	m.observeRequest(responseInfo{path: "/api/v1/status", status: 503, size: 10, start: now, end: now.Add(time.Millisecond)})
+	m.addRows(10, 2)
+	m.setConversion(3*time.Second, now.Add(-time.Minute))
+	m.addGitUpdate(FetchNoUpdate)
+	m.addRateLimited("/api/")
+
+	var buf bytes.Buffer
+	if err := m.write(&buf, now); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	// HELPの直後にTYPE、その後に同じ名前の系列だけが続く（系列が混ざらない）
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	seen := map[string]bool{}
+	family := ""
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			name := strings.Fields(line)[2]
+			if seen[name] {
+				t.Fatalf("line %d: %s is written twice", i+1, name)
+			}
+			seen[name] = true
+			if i+1 >= len(lines) || !strings.HasPrefix(lines[i+1], "# TYPE "+name+" ") {
+				t.Fatalf("line %d: HELP %s is not followed by its TYPE", i+1, name)
+			}
+			family = name
+		case strings.HasPrefix(line, "# TYPE "):
+			if name := strings.Fields(line)[2]; name != family {
+				t.Fatalf("line %d: TYPE %s without HELP", i+1, name)
+			}
+		default:
+			name := line
+			if j := strings.IndexAny(name, "{ "); j >= 0 {
+				name = name[:j]
+			}
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				if strings.HasSuffix(name, suffix) && strings.TrimSuffix(name, suffix) == family {
+					name = family
+				}
+			}
+			if name != family {
+				t.Fatalf("line %d: sample %s under %s", i+1, name, family)
+			}
+		}
+	}
+
+	for _, want := range []string{
+		`covid19chart_http_requests_total{route="data",status="2xx"} 1`,
+		`covid19chart_http_requests_total{route="api",status="5xx"} 1`,
+		`covid19chart_http_response_bytes_total{route="data"} 100`,
+		`covid19chart_http_response_seconds_bucket{route="data",le="0.025"} 1`,
+		`covid19chart_http_response_seconds_bucket{route="data",le="0.01"} 0`,
+		`covid19chart_http_response_seconds_count{route="data"} 1`,
+		`covid19chart_csv_rows_parsed_total 10`,
+		`covid19chart_csv_rows_rejected_total 2`,
+		`covid19chart_conversion_duration_seconds 3`,
+		`covid19chart_data_generation_age_seconds 60`,
+		`covid19chart_git_updates_total{result="no_update"} 1`,
+		`covid19chart_rate_limited_total{prefix="/api/"} 1`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("missing %q", want)
+		}
+	}
+	if t.Failed() {
+		t.Log(out)
+	}
+}
+
+// 一度もデータを変換していない場合は生成時刻の系列を出さない
+func TestMetricsWriteNoGeneration(t *testing.T) {
+	var buf bytes.Buffer
+	if err := newMetrics().write(&buf, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "# TYPE covid19chart_data_generation_age_seconds gauge\n") {
+		t.Fatal("missing header")
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "covid19chart_data_generation_") {
+			t.Fatalf("unexpected sample %q", line)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package app
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -9,23 +10,213 @@ import (
 )
 
 type responseInfo struct {
-	uri       string
-	userAgent string
-	status    int
-	size      int
-	start     time.Time
-	end       time.Time
-	method    string
-	host      string
-	protocol  string
-	addr      string
+	uri          string
+	path         string
+	userAgent    string
+	status       int
+	size         int
+	start        time.Time
+	end          time.Time
+	method       string
+	host         string
+	protocol     string
+	addr         string
+	user         string
+	referer      string
+	forwardedFor string
+	tlsVersion   string
+	requestID    string
+	traceID      string
 }
 type resultMonitor struct {
 	ResponseTimeSum     time.Duration
 	ResponseCount       uint
 	ResponseCodeOkCount uint
 	ResponseCodeNgCount uint
+	ResponseBytes       uint64
+	Percentiles         latencyPercentiles
+	StatusCodes         map[int]uint
+	Routes              map[string]*routeMonitor
+	AccessLogDropped    uint64
+	ConnectionRejected  uint64
+	RateLimited         uint64
+	sketch              *quantileSketch
 }
+type routeMonitor struct {
+	ResponseTimeSum time.Duration
+	ResponseCount   uint
+	ResponseBytes   uint64
+	Percentiles     latencyPercentiles
+	StatusCodes     map[int]uint
+	sketch          *quantileSketch
+}
+type latencyPercentiles struct {
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+}
+
+func newResultMonitor() resultMonitor {
+	return resultMonitor{
+		StatusCodes: make(map[int]uint),
+		Routes:      make(map[string]*routeMonitor),
+		sketch:      newQuantileSketch(),
+	}
+}
+
+// add レスポンス1件を集計に加える
+func (res *resultMonitor) add(ri responseInfo) {
+	ela := ri.end.Sub(ri.start)
+	res.ResponseCount++
+	res.ResponseTimeSum += ela
+	if ri.status < 400 {
+		res.ResponseCodeOkCount++
+	} else {
+		res.ResponseCodeNgCount++
+	}
+	res.ResponseBytes += uint64(ri.size)
+	res.StatusCodes[ri.status]++
+	res.sketch.add(ela.Seconds())
+
+	group := routeGroup(ri.path)
+	rm, ok := res.Routes[group]
+	if !ok {
+		rm = &routeMonitor{
+			StatusCodes: make(map[int]uint),
+			sketch:      newQuantileSketch(),
+		}
+		res.Routes[group] = rm
+	}
+	rm.ResponseCount++
+	rm.ResponseTimeSum += ela
+	rm.ResponseBytes += uint64(ri.size)
+	rm.StatusCodes[ri.status]++
+	rm.sketch.add(ela.Seconds())
+}
+
+// finalize 分位点を計算する
+// 以降は読み出し専用として扱うこと
+func (res *resultMonitor) finalize() {
+	res.Percentiles = sketchPercentiles(res.sketch)
+	for _, rm := range res.Routes {
+		rm.Percentiles = sketchPercentiles(rm.sketch)
+	}
+}
+
+// merge 集計結果を合算する（時系列のまとめ用）
+func (res *resultMonitor) merge(o resultMonitor) {
+	res.ResponseTimeSum += o.ResponseTimeSum
+	res.ResponseCount += o.ResponseCount
+	res.ResponseCodeOkCount += o.ResponseCodeOkCount
+	res.ResponseCodeNgCount += o.ResponseCodeNgCount
+	res.ResponseBytes += o.ResponseBytes
+	res.AccessLogDropped += o.AccessLogDropped
+	res.ConnectionRejected += o.ConnectionRejected
+	res.RateLimited += o.RateLimited
+	for code, n := range o.StatusCodes {
+		res.StatusCodes[code] += n
+	}
+	res.sketch.merge(o.sketch)
+	for group, orm := range o.Routes {
+		rm, ok := res.Routes[group]
+		if !ok {
+			rm = &routeMonitor{
+				StatusCodes: make(map[int]uint),
+				sketch:      newQuantileSketch(),
+			}
+			res.Routes[group] = rm
+		}
+		rm.ResponseTimeSum += orm.ResponseTimeSum
+		rm.ResponseCount += orm.ResponseCount
+		rm.ResponseBytes += orm.ResponseBytes
+		for code, n := range orm.StatusCodes {
+			rm.StatusCodes[code] += n
+		}
+		rm.sketch.merge(orm.sketch)
+	}
+}
+
+// monitorPoint 時刻付きの集計結果
+type monitorPoint struct {
+	Time time.Time
+	resultMonitor
+}
+
+// monitorRing 集計結果の履歴（古いものから上書き）
+type monitorRing struct {
+	buf  []monitorPoint
+	head int
+	n    int
+}
+
+func newMonitorRing(size int) *monitorRing {
+	if size < 1 {
+		size = 1
+	}
+	return &monitorRing{buf: make([]monitorPoint, size)}
+}
+
+func (r *monitorRing) push(p monitorPoint) {
+	r.buf[r.head] = p
+	r.head = (r.head + 1) % len(r.buf)
+	if r.n < len(r.buf) {
+		r.n++
+	}
+}
+
+// list 古い順に並べたコピーを返す
+func (r *monitorRing) list() []monitorPoint {
+	l := make([]monitorPoint, 0, r.n)
+	start := (r.head - r.n + len(r.buf)) % len(r.buf)
+	for i := 0; i < r.n; i++ {
+		l = append(l, r.buf[(start+i)%len(r.buf)])
+	}
+	return l
+}
+
+// monitorHistory webServerMonitoringProcから受け取る集計結果
+type monitorHistory struct {
+	latest  resultMonitor
+	minutes []monitorPoint
+	hours   []monitorPoint
+}
+
+// series windowの範囲をstep毎にまとめた時系列
+func (mh monitorHistory) series(now time.Time, window, step time.Duration) []monitorPoint {
+	src := mh.minutes
+	if step%time.Hour == 0 && (len(mh.minutes) == 0 || now.Add(-window).Before(mh.minutes[0].Time)) {
+		// 分単位の履歴で足りない場合は1時間単位を使う
+		src = mh.hours
+	}
+	from := now.Add(-window)
+	list := []monitorPoint{}
+	for _, p := range src {
+		if p.Time.Before(from) {
+			continue
+		}
+		t := p.Time.Truncate(step)
+		if len(list) == 0 || !list[len(list)-1].Time.Equal(t) {
+			list = append(list, monitorPoint{Time: t, resultMonitor: newResultMonitor()})
+		}
+		list[len(list)-1].merge(p.resultMonitor)
+	}
+	for i := range list {
+		list[i].finalize()
+	}
+	return list
+}
+
+func sketchPercentiles(s *quantileSketch) latencyPercentiles {
+	sec := func(q float64) time.Duration {
+		return time.Duration(s.quantile(q) * float64(time.Second))
+	}
+	return latencyPercentiles{
+		P50: sec(0.50),
+		P95: sec(0.95),
+		P99: sec(0.99),
+	}
+}
+
 type MonitoringResponseWriter struct {
 	http.ResponseWriter
 	ri   responseInfo
@@ -35,23 +226,52 @@ type MonitoringResponseWriter struct {
 // MonitoringHandler モニタリング用ハンドラ生成
 func MonitoringHandler(h http.Handler, rich chan<- responseInfo) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// リクエストIDはアクセスログとアプリケーションログの紐付け用
+		id := newRequestID(r)
+		r = r.WithContext(withRequestID(r.Context(), id))
+		ctx, sp := startServerSpan(r, r.Method+" "+routeGroup(r.URL.Path))
+		r = r.WithContext(ctx)
+		w.Header().Set(HeaderRequestID, id)
 		mrw := newMonitoringResponseWriter(w, r, rich)
-		defer mrw.Close()
+		defer func() {
+			mrw.Close()
+			sp.setAttr("http.method", r.Method)
+			sp.setAttr("url.path", r.URL.Path)
+			sp.setAttr("http.status_code", mrw.ri.status)
+			sp.setAttr("http.response_size", mrw.ri.size)
+			sp.setAttr("request_id", id)
+			if mrw.ri.status >= 500 {
+				sp.setError(errors.New(http.StatusText(mrw.ri.status)))
+			}
+			sp.end()
+		}()
 		h.ServeHTTP(mrw, r)
 	})
 }
 
 func newMonitoringResponseWriter(w http.ResponseWriter, r *http.Request, rich chan<- responseInfo) *MonitoringResponseWriter {
+	user, _, _ := r.BasicAuth()
+	var traceID string
+	if sp := spanFrom(r.Context()); sp != nil {
+		traceID = sp.TraceID
+	}
 	return &MonitoringResponseWriter{
 		ResponseWriter: w,
 		ri: responseInfo{
-			uri:       r.RequestURI,
-			userAgent: r.UserAgent(),
-			start:     time.Now().UTC(),
-			method:    r.Method,
-			protocol:  r.Proto,
-			host:      r.Host,
-			addr:      r.RemoteAddr,
+			uri:          r.RequestURI,
+			path:         r.URL.Path,
+			userAgent:    r.UserAgent(),
+			start:        time.Now().UTC(),
+			method:       r.Method,
+			protocol:     r.Proto,
+			host:         r.Host,
+			addr:         r.RemoteAddr,
+			user:         user,
+			referer:      r.Referer(),
+			forwardedFor: r.Header.Get("X-Forwarded-For"),
+			tlsVersion:   tlsVersionName(r.TLS),
+			requestID:    requestIDFrom(r.Context()),
+			traceID:      traceID,
 		},
 		rich: rich,
 	}
@@ -74,9 +294,15 @@ func (mrw *MonitoringResponseWriter) WriteHeader(statusCode int) {
 }
 
 // Close io.Closerのような感じにしたけど特に意味は無い
+// 集計側が詰まっていてもリクエストを止めないよう、キューが一杯なら捨てて数える
 func (mrw *MonitoringResponseWriter) Close() error {
 	mrw.ri.end = time.Now().UTC()
-	mrw.rich <- mrw.ri
+	stats.observeRequest(mrw.ri)
+	select {
+	case mrw.rich <- mrw.ri:
+	default:
+		stats.addAccessLogDropped()
+	}
 	return nil
 }
 
@@ -103,6 +329,11 @@ func (mrw *MonitoringResponseWriter) Flush() {
 	}
 }
 
+// Unwrap http.ResponseControllerから元のResponseWriterを辿れるようにする
+func (mrw *MonitoringResponseWriter) Unwrap() http.ResponseWriter {
+	return mrw.ResponseWriter
+}
+
 // Push http.Pusher interface
 // go1.8以上が必要
 func (mrw *MonitoringResponseWriter) Push(target string, opts *http.PushOptions) error {
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+const (
+	MetaDataPath = "./www/data/daily_reports/meta.json"
+
+	HeaderSourceCommit     = "X-Source-Commit"
+	HeaderSourceCommitTime = "X-Source-Commit-Time"
+)
+
+// sourceCommit 変換元になった元データのコミット
+type sourceCommit struct {
+	Hash    string    `json:"hash"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// dataMeta summary.jsonと同じ場所に置く変換データの由来
+type dataMeta struct {
+	Source    sourceCommit `json:"source"`
+	Generated time.Time    `json:"generated"`
+	First     string       `json:"first"`
+	Last      string       `json:"last"`
+	Files     int          `json:"files"`
+	Failed    int          `json:"failed"`
+}
+
+// provenance 配信中のデータの由来、一度も変換していない場合はnil
+var provenance atomic.Pointer[dataMeta]
+
+// gitCommit HEADのコミット情報
+func gitCommit(p string) (sourceCommit, error) {
+	r, err := git.PlainOpen(p)
+	if err != nil {
+		return sourceCommit{}, err
+	}
+	ref, err := r.Head()
+	if err != nil {
+		return sourceCommit{}, err
+	}
+	c, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		return sourceCommit{}, err
+	}
+	return sourceCommit{
+		Hash:    c.Hash.String(),
+		Time:    c.Committer.When,
+		Message: strings.TrimSpace(c.Message),
+	}, nil
+}
+
+func storeDataMeta(m *dataMeta) error {
+	err := storeFile(MetaDataPath, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(m)
+	})
+	if err != nil {
+		return &WriteError{Path: MetaDataPath, Err: err}
+	}
+	provenance.Store(m)
+	return nil
+}
+
+// loadDataMeta 起動時に前回の変換結果の由来を読み込む
+func loadDataMeta() error {
+	fp, err := os.Open(MetaDataPath)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	m := &dataMeta{}
+	if err := json.NewDecoder(fp).Decode(m); err != nil {
+		return err
+	}
+	provenance.Store(m)
+	return nil
+}
+
+// provenanceHeaders データファイルに元データのコミットを付ける
+func provenanceHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m := provenance.Load(); m != nil && m.Source.Hash != "" && strings.HasPrefix(r.URL.Path, "/data/") {
+			w.Header().Set(HeaderSourceCommit, m.Source.Hash)
+			w.Header().Set(HeaderSourceCommitTime, m.Source.Time.UTC().Format(time.RFC3339))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
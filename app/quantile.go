@@ -0,0 +1,77 @@
+package app
+
+import (
+	"math"
+	"sort"
+)
+
+// quantileSketch 相対誤差を保証する対数バケットの分位点推定（DDSketch方式）
+// 値を全部保持せずにp50/p95/p99を求めるためのもの
+type quantileSketch struct {
+	gamma   float64
+	lnGamma float64
+	bins    map[int]uint64
+	zero    uint64
+	count   uint64
+}
+
+const (
+	// 相対誤差1%
+	sketchRelativeAccuracy = 0.01
+	// これ以下の値は0として扱う
+	sketchMinValue = 1e-9
+)
+
+func newQuantileSketch() *quantileSketch {
+	gamma := (1 + sketchRelativeAccuracy) / (1 - sketchRelativeAccuracy)
+	return &quantileSketch{
+		gamma:   gamma,
+		lnGamma: math.Log(gamma),
+		bins:    make(map[int]uint64),
+	}
+}
+
+func (s *quantileSketch) add(v float64) {
+	s.count++
+	if v <= sketchMinValue {
+		s.zero++
+		return
+	}
+	s.bins[int(math.Ceil(math.Log(v)/s.lnGamma))]++
+}
+
+func (s *quantileSketch) merge(o *quantileSketch) {
+	if o == nil {
+		return
+	}
+	s.count += o.count
+	s.zero += o.zero
+	for k, v := range o.bins {
+		s.bins[k] += v
+	}
+}
+
+// quantile qは0〜1
+func (s *quantileSketch) quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(s.count-1))
+	if rank < s.zero {
+		return 0
+	}
+	keys := make([]int, 0, len(s.bins))
+	for k := range s.bins {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	n := s.zero
+	for _, k := range keys {
+		n += s.bins[k]
+		if n > rank {
+			// バケットの中央値を返す
+			return 2 * math.Pow(s.gamma, float64(k)) / (s.gamma + 1)
+		}
+	}
+	return 2 * math.Pow(s.gamma, float64(keys[len(keys)-1])) / (s.gamma + 1)
+}
@@ -0,0 +1,261 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitCleanupDuration 使われなくなったバケットを掃除する間隔
+const RateLimitCleanupDuration = time.Minute
+
+// RateLimitConfig クライアントIP単位のレート制限
+type RateLimitConfig struct {
+	// X-Forwarded-Forを信用するプロキシのアドレス（CIDRまたはIP）
+	TrustedProxies []string        `json:"trusted_proxies"`
+	Rules          []RateLimitRule `json:"rules"`
+}
+
+// RateLimitRule パスの前方一致ごとの制限、複数一致する場合は長いものを使う
+type RateLimitRule struct {
+	Prefix string `json:"prefix"`
+	// 1秒あたりに補充するリクエスト数
+	Rate float64 `json:"rate"`
+	// 連続して受け付けるリクエスト数
+	Burst int `json:"burst"`
+}
+
+func defaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		TrustedProxies: []string{"127.0.0.1/32", "::1/128"},
+		Rules: []RateLimitRule{
+			{Prefix: "/api/", Rate: 5, Burst: 20},
+			{Prefix: "/data/", Rate: 10, Burst: 50},
+		},
+	}
+}
+
+func (conf RateLimitConfig) validate() error {
+	if _, err := parseTrustedProxies(conf.TrustedProxies); err != nil {
+		return err
+	}
+	for _, r := range conf.Rules {
+		if !strings.HasPrefix(r.Prefix, "/") {
+			return fmt.Errorf("レート制限のパスは/から始めてください。:%s", r.Prefix)
+		}
+		if r.Rate <= 0 || r.Burst < 1 {
+			return fmt.Errorf("レート制限の設定が不正です。:%s", r.Prefix)
+		}
+	}
+	return nil
+}
+
+func parseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("プロキシのアドレスが不正です。:%s", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("プロキシのアドレスが不正です。:%s", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// tokenBucket 1クライアント分の残量
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateRule struct {
+	RateLimitRule
+	buckets map[string]*tokenBucket
+}
+
+// rateLimiter トークンバケットによるレート制限
+type rateLimiter struct {
+	sync.Mutex
+	rules   []*rateRule
+	trusted []*net.IPNet
+}
+
+func newRateLimiter(conf RateLimitConfig) (*rateLimiter, error) {
+	rl := &rateLimiter{}
+	if err := rl.update(conf); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// update 設定を差し替える
+// 同じパスのルールは残量を引き継ぐ
+func (rl *rateLimiter) update(conf RateLimitConfig) error {
+	trusted, err := parseTrustedProxies(conf.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	rl.Lock()
+	defer rl.Unlock()
+	old := make(map[string]*rateRule, len(rl.rules))
+	for _, r := range rl.rules {
+		old[r.Prefix] = r
+	}
+	rules := make([]*rateRule, 0, len(conf.Rules))
+	for _, r := range conf.Rules {
+		buckets := make(map[string]*tokenBucket)
+		if o, ok := old[r.Prefix]; ok {
+			buckets = o.buckets
+		}
+		delete(old, r.Prefix)
+		rules = append(rules, &rateRule{RateLimitRule: r, buckets: buckets})
+	}
+	for prefix := range old {
+		stats.setRateLimitClients(prefix, 0)
+	}
+	rl.rules = rules
+	rl.trusted = trusted
+	return nil
+}
+
+// rule 最も長く一致するもの
+func (rl *rateLimiter) rule(p string) *rateRule {
+	rl.Lock()
+	defer rl.Unlock()
+	var hit *rateRule
+	for _, r := range rl.rules {
+		if strings.HasPrefix(p, r.Prefix) && (hit == nil || len(r.Prefix) > len(hit.Prefix)) {
+			hit = r
+		}
+	}
+	return hit
+}
+
+// allow 受け付けない場合は次に受け付けられるまでの時間を返す
+func (rl *rateLimiter) allow(r *rateRule, client string, now time.Time) (bool, time.Duration) {
+	rl.Lock()
+	defer rl.Unlock()
+	b, ok := r.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: float64(r.Burst), last: now}
+		r.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(r.Burst), b.tokens+now.Sub(b.last).Seconds()*r.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / r.Rate * float64(time.Second))
+	return false, wait
+}
+
+// cleanup 満タンまで回復したバケットは持っていても意味が無いので捨てる
+func (rl *rateLimiter) cleanup(now time.Time) {
+	rl.Lock()
+	defer rl.Unlock()
+	for _, r := range rl.rules {
+		for client, b := range r.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*r.Rate >= float64(r.Burst) {
+				delete(r.buckets, client)
+			}
+		}
+		stats.setRateLimitClients(r.Prefix, len(r.buckets))
+	}
+}
+
+func (rl *rateLimiter) run(ctx context.Context) {
+	tc := time.NewTicker(RateLimitCleanupDuration)
+	defer tc.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tc.C:
+			rl.cleanup(now)
+		}
+	}
+}
+
+// clientIP 信用できるプロキシを経由している場合はX-Forwarded-Forを右から辿る
+func (rl *rateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !rl.isTrusted(host) {
+		return host
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hops = append(hops, h)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// 壊れた値より先は信用できない
+			break
+		}
+		host = hops[i]
+		if !rl.isTrusted(host) {
+			break
+		}
+	}
+	return host
+}
+
+func (rl *rateLimiter) isTrusted(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	rl.Lock()
+	defer rl.Unlock()
+	for _, n := range rl.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rl *rateLimiter) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule := rl.rule(r.URL.Path)
+		if rule == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		client := rl.clientIP(r)
+		if ok, wait := rl.allow(rule, client, time.Now()); !ok {
+			stats.addRateLimited(rule.Prefix)
+			requestLogger(r.Context()).Debugw("レート制限により拒否しました。", "client", client, "prefix", rule.Prefix)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "リクエストが多すぎます。", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
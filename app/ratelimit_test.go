@@ -0,0 +1,149 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter(t *testing.T, rules ...RateLimitRule) *rateLimiter {
+	t.Helper()
+	rl, err := newRateLimiter(RateLimitConfig{
+		TrustedProxies: []string{"127.0.0.1", "10.0.0.0/8", "::1/128"},
+		Rules:          rules,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rl
+}
+
+func TestRateLimiterClientIP(t *testing.T) {
+	rl := newTestRateLimiter(t)
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"direct", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted peer spoofs xff", "203.0.113.5:1234", []string{"1.2.3.4"}, "203.0.113.5"},
+		{"trusted peer without xff", "127.0.0.1:1234", nil, "127.0.0.1"},
+		{"trusted peer", "127.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		// 右から辿り、信用できない最初のアドレスで止める（左側は偽装できる）
+		{"trusted chain", "127.0.0.1:1234", []string{"6.6.6.6, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"multiple headers", "127.0.0.1:1234", []string{"6.6.6.6", "198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"all trusted", "127.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		// 壊れた値より先は信用しない
+		{"malformed hop", "127.0.0.1:1234", []string{"198.51.100.7, garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"malformed last hop", "127.0.0.1:1234", []string{"198.51.100.7, unknown"}, "127.0.0.1"},
+		{"ipv6 trusted peer", "[::1]:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/status", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := rl.clientIP(r); got != tt.want {
+				t.Fatalf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	rl := newTestRateLimiter(t, RateLimitRule{Prefix: "/api/", Rate: 2, Burst: 3})
+	rule := rl.rule("/api/v1/status")
+	if rule == nil {
+		t.Fatal("rule not found")
+	}
+	now := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.allow(rule, "a", now); !ok {
+			t.Fatalf("request %d: rejected within burst", i+1)
+		}
+	}
+	ok, wait := rl.allow(rule, "a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("over burst = %v %s, want false 500ms", ok, wait)
+	}
+	// クライアント毎に別のバケット
+	if ok, _ := rl.allow(rule, "b", now); !ok {
+		t.Fatal("other client rejected")
+	}
+	// 0.5秒で1つ補充される
+	if ok, _ := rl.allow(rule, "a", now.Add(250*time.Millisecond)); ok {
+		t.Fatal("allowed before refill")
+	}
+	if ok, _ := rl.allow(rule, "a", now.Add(750*time.Millisecond)); !ok {
+		t.Fatal("rejected after refill")
+	}
+	// 長く空いてもburstを超えては貯まらない
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.allow(rule, "a", later); !ok {
+			t.Fatalf("request %d after idle: rejected", i+1)
+		}
+	}
+	if ok, _ := rl.allow(rule, "a", later); ok {
+		t.Fatal("burst exceeded after idle")
+	}
+}
+
+func TestRateLimiterRule(t *testing.T) {
+	rl := newTestRateLimiter(t,
+		RateLimitRule{Prefix: "/api/", Rate: 1, Burst: 1},
+		RateLimitRule{Prefix: "/api/v1/admin/", Rate: 1, Burst: 1},
+	)
+	for p, want := range map[string]string{
+		"/api/v1/status":       "/api/",
+		"/api/v1/admin/reload": "/api/v1/admin/",
+		"/data/summary.json":   "",
+	} {
+		got := ""
+		if r := rl.rule(p); r != nil {
+			got = r.Prefix
+		}
+		if got != want {
+			t.Errorf("rule(%s) = %q, want %q", p, got, want)
+		}
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	rl := newTestRateLimiter(t, RateLimitRule{Prefix: "/api/", Rate: 0.5, Burst: 2})
+	h := rl.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	do := func(path, remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := do("/api/v1/status", "203.0.113.5:1"); w.Code != http.StatusNoContent {
+			t.Fatalf("request %d: status = %d", i+1, w.Code)
+		}
+	}
+	w := do("/api/v1/status", "203.0.113.5:2")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+	// 0.5回/秒なので次の1回分まで2秒
+	if ra := w.Header().Get("Retry-After"); ra != "2" {
+		t.Fatalf("Retry-After = %q, want 2", ra)
+	}
+	if w := do("/api/v1/status", "203.0.113.6:1"); w.Code != http.StatusNoContent {
+		t.Fatalf("other client: status = %d", w.Code)
+	}
+	for i := 0; i < 5; i++ {
+		if w := do("/data/summary.json", "203.0.113.5:3"); w.Code != http.StatusNoContent {
+			t.Fatalf("unlimited path: status = %d", w.Code)
+		}
+	}
+}
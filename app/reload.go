@@ -0,0 +1,193 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// swapHandler 稼働中のサーバを止めずにハンドラを差し替える
+type swapHandler struct {
+	h atomic.Pointer[http.Handler]
+}
+
+func (sh *swapHandler) store(h http.Handler) {
+	sh.h.Store(&h)
+}
+
+func (sh *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*sh.h.Load()).ServeHTTP(w, r)
+}
+
+// waitReload 終了の指示があるまでSIGHUPで設定を読み直す
+func (app *application) waitReload(ctx context.Context, hup <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := app.reload(ctx); err != nil {
+				log.Warnw("設定の再読み込みに失敗しました。現在の設定のまま動作を続けます。", "error", err, "path", app.config().path)
+			}
+		}
+	}
+}
+
+// reload 設定ファイル、表記揺れ表、ログファイル、ハンドラ、待ち受けを差し替える
+// 全ての読み込みと検証が済むまでは稼働中の状態に手を付けない
+func (app *application) reload(ctx context.Context) error {
+	cur := app.config()
+	log.Infow("設定を再読み込みします。", "path", cur.path)
+	conf, err := LoadConfig(cur.path)
+	if err != nil {
+		return err
+	}
+	if ignored := conf.keepStatic(cur); len(ignored) > 0 {
+		log.Warnw("再起動しないと反映されない項目があります。", "fields", ignored)
+	}
+	aliases, err := readCountryAlias(conf.AliasPath)
+	if err != nil {
+		return err
+	}
+	var t *tracer
+	if conf.Tracing.File != "" {
+		if t, err = newTracer(conf.Tracing.File); err != nil {
+			return err
+		}
+	}
+	// 設定の変わった待ち受けだけ作り直す
+	app.serversMu.Lock()
+	defer app.serversMu.Unlock()
+	next := activeListeners(conf)
+	var keep, stop []serverItem
+	for _, srv := range app.servers {
+		if i := findListener(next, srv.conf.Addr); i >= 0 && reflect.DeepEqual(next[i], srv.conf) && srv.sc == conf.Server {
+			keep = append(keep, srv)
+		} else {
+			stop = append(stop, srv)
+		}
+	}
+	var fresh, replace []serverItem
+	for _, lc := range next {
+		if findServer(keep, lc.Addr) >= 0 {
+			continue
+		}
+		si, err := newServerItem(lc, conf.Server, &app.handler)
+		if err != nil {
+			if t != nil {
+				t.close()
+			}
+			return err
+		}
+		if findServer(stop, lc.Addr) >= 0 {
+			replace = append(replace, si)
+		} else {
+			fresh = append(fresh, si)
+		}
+	}
+	// 新しいアドレスは稼働中のものに影響しないので先に開く
+	for i := range fresh {
+		if err := fresh[i].bind(); err != nil {
+			unbind(fresh)
+			if t != nil {
+				t.close()
+			}
+			return err
+		}
+	}
+	// 同じアドレスの作り直しは古いものを止めないと開けない
+	// 開けなかった場合は元の設定で開き直す
+	if len(replace) > 0 {
+		var old, rest []serverItem
+		for _, srv := range stop {
+			if findServer(replace, srv.conf.Addr) >= 0 {
+				old = append(old, srv)
+			} else {
+				rest = append(rest, srv)
+			}
+		}
+		stopServers(old, time.Duration(cur.Server.DrainTimeout))
+		for i := range replace {
+			if err := replace[i].bind(); err != nil {
+				unbind(replace)
+				unbind(fresh)
+				app.servers = append(keep, rest...)
+				for _, srv := range app.restoreServers(old) {
+					app.launch(srv)
+				}
+				if t != nil {
+					t.close()
+				}
+				return err
+			}
+		}
+		stop = rest
+	}
+	start := append(fresh, replace...)
+
+	// ここから差し替え
+	app.conf.Store(conf)
+	if setCountryAlias(aliases) {
+		// 変換済みデータに反映する
+		log.Infow("表記揺れ表が変わったため再変換します。", "count", len(aliases))
+		app.scheduler.trigger(true)
+	}
+	if old := tracing.Swap(t); old != nil {
+		old.close()
+	}
+	if err := app.limiter.update(conf.RateLimit); err != nil {
+		// 検証済みなのでここには来ない
+		log.Warnw("レート制限の更新に失敗しました。", "error", err)
+	}
+	app.handler.store(app.routes.handler(conf))
+	select {
+	case app.logReload <- conf.AccessLog:
+	case <-ctx.Done():
+	}
+	stopServers(stop, time.Duration(conf.Server.DrainTimeout))
+	app.servers = keep
+	for _, s := range start {
+		app.launch(s)
+	}
+	log.Infow("設定を再読み込みしました。", "listeners", len(app.servers), "started", len(start))
+	return nil
+}
+
+// restoreServers 止めた待ち受けを元の設定で作り直す
+// 開き直せなかったものはログに残して諦める
+func (app *application) restoreServers(sl []serverItem) []serverItem {
+	restored := make([]serverItem, 0, len(sl))
+	for _, old := range sl {
+		si, err := newServerItem(old.conf, old.sc, &app.handler)
+		if err == nil {
+			err = si.bind()
+		}
+		if err != nil {
+			log.Errorw("元の待ち受けを開き直せませんでした。", "error", err, "Addr", old.conf.Addr)
+			continue
+		}
+		restored = append(restored, si)
+	}
+	return restored
+}
+
+func findListener(list []ListenerConfig, addr string) int {
+	for i, lc := range list {
+		if lc.Addr == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+func findServer(list []serverItem, addr string) int {
+	for i, srv := range list {
+		if srv.conf.Addr == addr {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,447 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// RebuildDataPath rebuildの出力先の既定値、コミット毎にフォルダを分ける
+const RebuildDataPath = "./data/rebuild"
+
+var revisionDateRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+
+// RebuildOptions rebuildの設定
+type RebuildOptions struct {
+	// 元データのリポジトリ、全履歴をcloneしておく必要がある（git.depth=0）
+	Repo string
+	// コミット（ハッシュ、ブランチ、HEAD~1など）または日付（2006-01-02）
+	// 日付の場合はその日の終わりまでに入った最後のコミット
+	Rev string
+	// 空の場合はRebuildDataPath/<コミット>
+	Out string
+	// 国名の表記揺れ表、配信中のデータと同じ国のまとめ方にする
+	AliasPath string
+}
+
+// DiffOptions diff-revisionsの設定
+type DiffOptions struct {
+	Repo string
+	// RebuildOptions.Revと同じ形式
+	From string
+	To   string
+	// textかjson
+	Format string
+	// 国単位の変更の上位件数、0の場合は全て
+	Top       int
+	AliasPath string
+}
+
+// revisionData あるコミット時点の変換結果
+type revisionData struct {
+	Source sourceCommit
+	Days   map[string]map[string]*Dataset
+	Dates  []string
+	Result conversionResult
+}
+
+// RevisionDiff diff-revisionsの比較結果
+type RevisionDiff struct {
+	From         sourceCommit    `json:"from"`
+	To           sourceCommit    `json:"to"`
+	DatesAdded   []string        `json:"dates_added"`
+	DatesRemoved []string        `json:"dates_removed"`
+	Dates        []DateChange    `json:"dates"`
+	Countries    []CountryChange `json:"countries"`
+	// Topで絞る前の国単位の変更の件数
+	Total int `json:"total"`
+}
+
+// DateChange 日付単位の変更、CDRは全ての国の合計
+type DateChange struct {
+	Date      string   `json:"date"`
+	Countries int      `json:"countries"`
+	Delta     [3]int64 `json:"delta"`
+}
+
+// CountryChange 国単位の変更、片方にしか無い国は無い側を0とする
+type CountryChange struct {
+	Date    string    `json:"date"`
+	Country string    `json:"country"`
+	Before  [3]uint64 `json:"before"`
+	After   [3]uint64 `json:"after"`
+	Delta   [3]int64  `json:"delta"`
+}
+
+// Rebuild 指定したコミット時点の元データを変換して書き出す
+// 作業ツリーは変更せず、コミットのツリーから直接読む
+func Rebuild(w io.Writer, opts RebuildOptions) error {
+	if _, err := loadCountryAlias(opts.AliasPath); err != nil {
+		return err
+	}
+	r, err := openRevisionRepo(opts.Repo)
+	if err != nil {
+		return err
+	}
+	rd, err := readRevision(r, opts.Rev)
+	if err != nil {
+		return err
+	}
+	out := opts.Out
+	if out == "" {
+		out = filepath.Join(RebuildDataPath, rd.Source.Hash[:12])
+	}
+	jsondir := filepath.Join(out, "json")
+	if err := checkAndCreateDir(jsondir); err != nil {
+		return &WriteError{Path: jsondir, Err: err}
+	}
+	ws := &WorldSummary{
+		Countrys: make(map[string]CountrySummary, 256),
+	}
+	for _, date := range rd.Dates {
+		cmap := rd.Days[date]
+		p := filepath.Join(jsondir, date+".json")
+		err := storeFile(p, func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(cmap)
+		})
+		if err != nil {
+			return &WriteError{Path: p, Err: err}
+		}
+		t, _ := time.Parse("2006-01-02", date)
+		ws = appendSummary(ws, cmap, t)
+	}
+	totalSummary(ws)
+	p := filepath.Join(out, "summary.json")
+	err = storeFile(p, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(ws)
+	})
+	if err != nil {
+		return &WriteError{Path: p, Err: err}
+	}
+	m := &dataMeta{
+		Source:    rd.Source,
+		Generated: time.Now(),
+		Files:     rd.Result.Files,
+		Failed:    rd.Result.Failed,
+	}
+	if len(rd.Dates) > 0 {
+		m.First = rd.Dates[0]
+		m.Last = rd.Dates[len(rd.Dates)-1]
+	}
+	p = filepath.Join(out, "meta.json")
+	err = storeFile(p, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(m)
+	})
+	if err != nil {
+		return &WriteError{Path: p, Err: err}
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "commit\t%s\n", rd.Source.Hash)
+	fmt.Fprintf(tw, "time\t%s\n", rd.Source.Time.Format(time.RFC3339))
+	fmt.Fprintf(tw, "message\t%s\n", firstLine(rd.Source.Message))
+	fmt.Fprintf(tw, "period\t%s - %s\n", dash(m.First), dash(m.Last))
+	fmt.Fprintf(tw, "files\t%d\n", rd.Result.Files)
+	fmt.Fprintf(tw, "failed\t%d\n", rd.Result.Failed)
+	for _, f := range rd.Result.Failures {
+		fmt.Fprintf(tw, "\t%s\t%s\n", f.File, f.Error)
+	}
+	fmt.Fprintf(tw, "output\t%s\n", out)
+	return tw.Flush()
+}
+
+// DiffRevisions 2つのコミット時点の変換結果を比べ、過去の数値がどう変わったかを出力する
+func DiffRevisions(w io.Writer, opts DiffOptions) error {
+	if _, err := loadCountryAlias(opts.AliasPath); err != nil {
+		return err
+	}
+	r, err := openRevisionRepo(opts.Repo)
+	if err != nil {
+		return err
+	}
+	from, err := readRevision(r, opts.From)
+	if err != nil {
+		return err
+	}
+	to, err := readRevision(r, opts.To)
+	if err != nil {
+		return err
+	}
+	diff := diffRevisions(from, to, opts.Top)
+	switch opts.Format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(diff)
+	case "", "text":
+		return diff.writeText(w)
+	}
+	return fmt.Errorf("出力形式が不正です。:%s", opts.Format)
+}
+
+func openRevisionRepo(p string) (*git.Repository, error) {
+	if p == "" {
+		p = GitPath
+	}
+	r, err := git.PlainOpen(p)
+	if err != nil {
+		return nil, fmt.Errorf("リポジトリを開けませんでした。:%s %w", p, err)
+	}
+	return r, nil
+}
+
+// resolveRevision コミットまたは日付からコミットを探す
+func resolveRevision(r *git.Repository, rev string) (*object.Commit, error) {
+	if rev == "" {
+		rev = "HEAD"
+	}
+	if !revisionDateRegexp.MatchString(rev) {
+		h, err := r.ResolveRevision(plumbing.Revision(rev))
+		if err != nil {
+			return nil, fmt.Errorf("コミットが見つかりません。:%s %w", rev, err)
+		}
+		return r.CommitObject(*h)
+	}
+	day, err := time.ParseInLocation("2006-01-02", rev, time.UTC)
+	if err != nil {
+		return nil, fmt.Errorf("日付が不正です。:%s", rev)
+	}
+	end := day.AddDate(0, 0, 1)
+	head, err := r.Head()
+	if err != nil {
+		return nil, err
+	}
+	iter, err := r.Log(&git.LogOptions{From: head.Hash(), Order: git.LogOrderCommitterTime})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	var hit *object.Commit
+	err = iter.ForEach(func(c *object.Commit) error {
+		if c.Committer.When.Before(end) {
+			hit = c
+			return storer.ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("履歴を辿れませんでした。全履歴をcloneしてください（git.depth=0）。:%w", err)
+	}
+	if hit == nil {
+		if shallow, _ := r.Storer.Shallow(); len(shallow) > 0 {
+			return nil, fmt.Errorf("%s以前のコミットがありません。全履歴をcloneしてください（git.depth=0）。", rev)
+		}
+		return nil, fmt.Errorf("%s以前のコミットがありません。", rev)
+	}
+	return hit, nil
+}
+
+// readRevision コミットのツリーから日毎のCSVを読んで変換する
+// 変換に失敗したファイルは飛ばし、Resultに記録する
+func readRevision(r *git.Repository, rev string) (*revisionData, error) {
+	c, err := resolveRevision(r, rev)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := tree.Tree(RepoDataDir)
+	if err != nil {
+		return nil, fmt.Errorf("%sに日毎のデータがありません。:%w", c.Hash, err)
+	}
+	rd := &revisionData{
+		Source: sourceCommit{
+			Hash:    c.Hash.String(),
+			Time:    c.Committer.When,
+			Message: strings.TrimSpace(c.Message),
+		},
+		Days: make(map[string]map[string]*Dataset, len(dir.Entries)),
+	}
+	for _, e := range dir.Entries {
+		ext := path.Ext(e.Name)
+		if !e.Mode.IsFile() || ext != ".csv" {
+			continue
+		}
+		t, err := time.Parse("01-02-2006", strings.TrimSuffix(e.Name, ext))
+		if err != nil {
+			continue
+		}
+		rd.Result.Files++
+		cmap, err := readRevisionFile(dir, e.Name)
+		if err != nil {
+			if errors.Is(err, plumbing.ErrObjectNotFound) {
+				// 部分clone（--filter=blob:none）では過去のファイルの中身が無い
+				return nil, fmt.Errorf("%sの中身がありません。全履歴をcloneしてください。:%w", e.Name, err)
+			}
+			rd.Result.fail(e.Name, err)
+			continue
+		}
+		date := t.Format("2006-01-02")
+		rd.Days[date] = cmap
+		rd.Dates = append(rd.Dates, date)
+	}
+	if rd.Result.Files == 0 {
+		return nil, fmt.Errorf("%sにデータファイルがありませんでした。", c.Hash)
+	}
+	sort.Strings(rd.Dates)
+	return rd, nil
+}
+
+func readRevisionFile(dir *object.Tree, name string) (map[string]*Dataset, error) {
+	f, err := dir.File(name)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := f.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return parseCountryCSV(rc)
+}
+
+func diffRevisions(from, to *revisionData, top int) *RevisionDiff {
+	diff := &RevisionDiff{
+		From:         from.Source,
+		To:           to.Source,
+		DatesAdded:   []string{},
+		DatesRemoved: []string{},
+		Dates:        []DateChange{},
+		Countries:    []CountryChange{},
+	}
+	dates := make(map[string]struct{}, len(to.Dates))
+	for _, d := range from.Dates {
+		dates[d] = struct{}{}
+		if _, ok := to.Days[d]; !ok {
+			diff.DatesRemoved = append(diff.DatesRemoved, d)
+		}
+	}
+	for _, d := range to.Dates {
+		dates[d] = struct{}{}
+		if _, ok := from.Days[d]; !ok {
+			diff.DatesAdded = append(diff.DatesAdded, d)
+		}
+	}
+	all := make([]string, 0, len(dates))
+	for d := range dates {
+		all = append(all, d)
+	}
+	sort.Strings(all)
+	for _, d := range all {
+		before, after := from.Days[d], to.Days[d]
+		countries := make(map[string]struct{}, len(after))
+		for name := range before {
+			countries[name] = struct{}{}
+		}
+		for name := range after {
+			countries[name] = struct{}{}
+		}
+		dc := DateChange{Date: d}
+		for name := range countries {
+			cc := CountryChange{
+				Date:    d,
+				Country: name,
+				Before:  cdr(before[name]),
+				After:   cdr(after[name]),
+			}
+			changed := false
+			for i := range cc.Delta {
+				cc.Delta[i] = int64(cc.After[i]) - int64(cc.Before[i])
+				dc.Delta[i] += cc.Delta[i]
+				changed = changed || cc.Delta[i] != 0
+			}
+			_, inBefore := before[name]
+			_, inAfter := after[name]
+			if changed || inBefore != inAfter {
+				dc.Countries++
+				diff.Countries = append(diff.Countries, cc)
+			}
+		}
+		if dc.Countries > 0 {
+			diff.Dates = append(diff.Dates, dc)
+		}
+	}
+	// 変化の大きいものから
+	sort.Slice(diff.Countries, func(i, j int) bool {
+		a, b := diff.Countries[i], diff.Countries[j]
+		if ma, mb := magnitude(a.Delta), magnitude(b.Delta); ma != mb {
+			return ma > mb
+		}
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		return a.Country < b.Country
+	})
+	diff.Total = len(diff.Countries)
+	if top > 0 && len(diff.Countries) > top {
+		diff.Countries = diff.Countries[:top]
+	}
+	return diff
+}
+
+func cdr(ds *Dataset) [3]uint64 {
+	if ds == nil {
+		return [3]uint64{}
+	}
+	return [3]uint64{ds.Confirmed, ds.Deaths, ds.Recovered}
+}
+
+// magnitude 感染者数、死者数、回復者数の変化量の絶対値の合計
+func magnitude(d [3]int64) int64 {
+	var n int64
+	for _, v := range d {
+		if v < 0 {
+			v = -v
+		}
+		n += v
+	}
+	return n
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+func (diff *RevisionDiff) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "from\t%s\t%s\t%s\n", diff.From.Hash[:12], diff.From.Time.Format(time.RFC3339), firstLine(diff.From.Message))
+	fmt.Fprintf(tw, "to\t%s\t%s\t%s\n", diff.To.Hash[:12], diff.To.Time.Format(time.RFC3339), firstLine(diff.To.Message))
+	fmt.Fprintf(tw, "dates added\t%s\n", dash(strings.Join(diff.DatesAdded, " ")))
+	fmt.Fprintf(tw, "dates removed\t%s\n", dash(strings.Join(diff.DatesRemoved, " ")))
+	fmt.Fprintf(tw, "changed dates\t%d\n", len(diff.Dates))
+	fmt.Fprintf(tw, "changed countries\t%d\n", diff.Total)
+
+	fmt.Fprintf(tw, "\nDATE\tCOUNTRIES\tCONFIRMED\tDEATHS\tRECOVERED\n")
+	for _, dc := range diff.Dates {
+		fmt.Fprintf(tw, "%s\t%d\t%+d\t%+d\t%+d\n", dc.Date, dc.Countries, dc.Delta[0], dc.Delta[1], dc.Delta[2])
+	}
+
+	fmt.Fprintf(tw, "\nDATE\tCOUNTRY\tCONFIRMED\tDEATHS\tRECOVERED\n")
+	for _, cc := range diff.Countries {
+		fmt.Fprintf(tw, "%s\t%s", cc.Date, cc.Country)
+		for i := range cc.Delta {
+			fmt.Fprintf(tw, "\t%d -> %d (%+d)", cc.Before[i], cc.After[i], cc.Delta[i])
+		}
+		fmt.Fprintf(tw, "\n")
+	}
+	return tw.Flush()
+}
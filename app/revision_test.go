@@ -0,0 +1,109 @@
+package app
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func testRevision(hash string, days map[string]map[string]*Dataset) *revisionData {
+	rd := &revisionData{Source: sourceCommit{Hash: hash}, Days: days}
+	for d := range days {
+		rd.Dates = append(rd.Dates, d)
+	}
+	sort.Strings(rd.Dates)
+	return rd
+}
+
+func TestDiffRevisions(t *testing.T) {
+	from := testRevision("from", map[string]map[string]*Dataset{
+		"2020-03-01": {
+			"Japan": {Confirmed: 10, Recovered: 1},
+			"Italy": {Confirmed: 20, Deaths: 1},
+		},
+		"2020-03-02": {
+			"Japan":  {Confirmed: 15, Recovered: 1},
+			"Italy":  {Confirmed: 30, Deaths: 2},
+			"France": {Confirmed: 5},
+		},
+		"2020-03-03": {
+			"Japan": {Confirmed: 20},
+		},
+	})
+	to := testRevision("to", map[string]map[string]*Dataset{
+		// 変化の無い日付は出さない
+		"2020-03-01": {
+			"Japan": {Confirmed: 10, Recovered: 1},
+			"Italy": {Confirmed: 20, Deaths: 1},
+		},
+		"2020-03-02": {
+			"Japan": {Confirmed: 17, Recovered: 1},
+			"Italy": {Confirmed: 40, Deaths: 2},
+			"Spain": {Confirmed: 5},
+			// 値が0でも新しく現れた国は変更として扱う
+			"Korea": {},
+		},
+		"2020-03-04": {
+			"Japan": {Confirmed: 25, Deaths: 1, Recovered: 2},
+			"Italy": {Confirmed: 20},
+		},
+	})
+	countries := []CountryChange{
+		{Date: "2020-03-04", Country: "Japan", After: [3]uint64{25, 1, 2}, Delta: [3]int64{25, 1, 2}},
+		// 変化量が同じなら日付順、さらに国名順
+		{Date: "2020-03-03", Country: "Japan", Before: [3]uint64{20, 0, 0}, Delta: [3]int64{-20, 0, 0}},
+		{Date: "2020-03-04", Country: "Italy", After: [3]uint64{20, 0, 0}, Delta: [3]int64{20, 0, 0}},
+		{Date: "2020-03-02", Country: "Italy", Before: [3]uint64{30, 2, 0}, After: [3]uint64{40, 2, 0}, Delta: [3]int64{10, 0, 0}},
+		{Date: "2020-03-02", Country: "France", Before: [3]uint64{5, 0, 0}, Delta: [3]int64{-5, 0, 0}},
+		{Date: "2020-03-02", Country: "Spain", After: [3]uint64{5, 0, 0}, Delta: [3]int64{5, 0, 0}},
+		{Date: "2020-03-02", Country: "Japan", Before: [3]uint64{15, 0, 1}, After: [3]uint64{17, 0, 1}, Delta: [3]int64{2, 0, 0}},
+		{Date: "2020-03-02", Country: "Korea"},
+	}
+	want := &RevisionDiff{
+		From:         sourceCommit{Hash: "from"},
+		To:           sourceCommit{Hash: "to"},
+		DatesAdded:   []string{"2020-03-04"},
+		DatesRemoved: []string{"2020-03-03"},
+		Dates: []DateChange{
+			{Date: "2020-03-02", Countries: 5, Delta: [3]int64{12, 0, 0}},
+			{Date: "2020-03-03", Countries: 1, Delta: [3]int64{-20, 0, 0}},
+			{Date: "2020-03-04", Countries: 2, Delta: [3]int64{45, 1, 2}},
+		},
+		Countries: countries,
+		Total:     len(countries),
+	}
+
+	for _, top := range []int{0, len(countries), len(countries) + 1} {
+		if got := diffRevisions(from, to, top); !reflect.DeepEqual(got, want) {
+			t.Fatalf("top %d:\ngot  %+v\nwant %+v", top, got, want)
+		}
+	}
+
+	// Topは国単位の変更だけを絞り、件数と日付単位の集計はそのまま
+	got := diffRevisions(from, to, 3)
+	if !reflect.DeepEqual(got.Countries, countries[:3]) {
+		t.Fatalf("top 3 = %+v, want %+v", got.Countries, countries[:3])
+	}
+	if got.Total != len(countries) || !reflect.DeepEqual(got.Dates, want.Dates) {
+		t.Fatalf("top 3: total = %d, dates = %+v", got.Total, got.Dates)
+	}
+
+	// 逆向きに比較すると追加と削除が入れ替わる
+	rev := diffRevisions(to, from, 0)
+	if !reflect.DeepEqual(rev.DatesAdded, want.DatesRemoved) || !reflect.DeepEqual(rev.DatesRemoved, want.DatesAdded) {
+		t.Fatalf("reverse: added = %v, removed = %v", rev.DatesAdded, rev.DatesRemoved)
+	}
+	if rev.Total != want.Total {
+		t.Fatalf("reverse: total = %d, want %d", rev.Total, want.Total)
+	}
+}
+
+func TestDiffRevisionsSame(t *testing.T) {
+	days := map[string]map[string]*Dataset{
+		"2020-03-01": {"Japan": {Confirmed: 10}},
+	}
+	got := diffRevisions(testRevision("a", days), testRevision("b", days), 0)
+	if len(got.DatesAdded) != 0 || len(got.DatesRemoved) != 0 || len(got.Dates) != 0 || len(got.Countries) != 0 || got.Total != 0 {
+		t.Fatalf("diff = %+v, want empty", got)
+	}
+}
@@ -0,0 +1,314 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// schedule 次の実行時刻を返す
+type schedule interface {
+	next(t time.Time) time.Time
+}
+
+type everySchedule time.Duration
+
+func (s everySchedule) next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// cronSchedule 分 時 日 月 曜日 の5項目
+type cronSchedule struct {
+	minute [60]bool
+	hour   [24]bool
+	dom    [32]bool
+	month  [13]bool
+	dow    [7]bool
+	// 日と曜日のどちらかが*の場合はもう一方だけで判定する
+	domAny bool
+	dowAny bool
+}
+
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("実行間隔が不正です。:%s", spec)
+		}
+		return everySchedule(d), nil
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron形式は5項目です。:%s", spec)
+	}
+	cs := &cronSchedule{}
+	items := []struct {
+		set      []bool
+		min, max int
+	}{
+		{cs.minute[:], 0, 59},
+		{cs.hour[:], 0, 23},
+		{cs.dom[:], 1, 31},
+		{cs.month[:], 1, 12},
+		{cs.dow[:], 0, 7},
+	}
+	for i, it := range items {
+		set := it.set
+		if i == 4 {
+			// 曜日は7も日曜として扱う
+			set = make([]bool, 8)
+		}
+		if err := parseCronField(fields[i], set, it.min, it.max); err != nil {
+			return nil, fmt.Errorf("cron形式の%d項目目が不正です。:%s %w", i+1, fields[i], err)
+		}
+		if i == 4 {
+			copy(cs.dow[:], set[:7])
+			cs.dow[0] = cs.dow[0] || set[7]
+		}
+	}
+	cs.domAny = fields[2] == "*"
+	cs.dowAny = fields[4] == "*"
+	return cs, nil
+}
+
+func parseCronField(field string, set []bool, min, max int) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return fmt.Errorf("間隔が不正です。")
+			}
+			step = s
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			if i := strings.Index(part, "-"); i >= 0 {
+				var err error
+				if lo, err = strconv.Atoi(part[:i]); err != nil {
+					return err
+				}
+				if hi, err = strconv.Atoi(part[i+1:]); err != nil {
+					return err
+				}
+			} else {
+				v, err := strconv.Atoi(part)
+				if err != nil {
+					return err
+				}
+				lo = v
+				if step == 1 {
+					hi = v
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return fmt.Errorf("範囲外です。")
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+func (cs *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// 最長でも4年先までに見つからなければ諦める（2/29のみ指定など）
+	limit := t.AddDate(4, 0, 0)
+	for t.Before(limit) {
+		if !cs.month[t.Month()] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.hour[t.Hour()] {
+			// Truncateは絶対時刻で丸めるので、+05:30等の地域では正時にならない
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (cs *cronSchedule) matchDay(t time.Time) bool {
+	dom := cs.dom[t.Day()]
+	dow := cs.dow[t.Weekday()]
+	switch {
+	case cs.domAny && cs.dowAny:
+		return true
+	case cs.domAny:
+		return dow
+	case cs.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// updateScheduler データ更新の定期実行
+type updateScheduler struct {
+	enabled    bool
+	sched      schedule
+	jitter     time.Duration
+	backoffMin time.Duration
+	backoffMax time.Duration
+	job        func(ctx context.Context, force bool) error
+	// 配信できるデータがあるか、無い間は定期実行が無効でも失敗後に再試行する
+	hasData func() bool
+	trig    chan bool
+	running int32
+	wg      sync.WaitGroup
+}
+
+func newUpdateScheduler(conf UpdateConfig, job func(ctx context.Context, force bool) error) (*updateScheduler, error) {
+	sched, err := parseSchedule(conf.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	return &updateScheduler{
+		enabled:    conf.Enable,
+		sched:      sched,
+		jitter:     time.Duration(conf.Jitter),
+		backoffMin: time.Duration(conf.BackoffMin),
+		backoffMax: time.Duration(conf.BackoffMax),
+		job:        job,
+		hasData:    func() bool { return !stats.dataGeneration().IsZero() },
+		trig:       make(chan bool, 1),
+	}, nil
+}
+
+// trigger 手動実行の要求
+// forceがtrueの場合はgitの更新が無くても再変換する
+// 実行中または要求済みの場合はfalseを返す
+func (us *updateScheduler) trigger(force bool) bool {
+	if atomic.LoadInt32(&us.running) != 0 {
+		return false
+	}
+	select {
+	case us.trig <- force:
+		return true
+	default:
+		return false
+	}
+}
+
+func (us *updateScheduler) isRunning() bool {
+	return atomic.LoadInt32(&us.running) != 0
+}
+
+// backoff 連続失敗回数に応じた待ち時間
+func (us *updateScheduler) backoff(failures int) time.Duration {
+	d := us.backoffMin
+	for i := 1; i < failures && d < us.backoffMax; i++ {
+		d *= 2
+	}
+	if d > us.backoffMax {
+		d = us.backoffMax
+	}
+	return d
+}
+
+// nextTime 次回の実行時刻
+// 定期実行が無効の場合はゼロ値を返す（手動実行のみ受け付ける）
+// ただし一度もデータを作れていない間は、失敗後にバックオフして再試行する
+func (us *updateScheduler) nextTime(now time.Time, failures int) time.Time {
+	if failures > 0 && (us.enabled || !us.hasData()) {
+		return now.Add(us.backoff(failures))
+	}
+	if !us.enabled {
+		return time.Time{}
+	}
+	next := us.sched.next(now)
+	if us.jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(us.jitter))))
+	}
+	return next
+}
+
+func (us *updateScheduler) run(ctx context.Context) {
+	defer us.wg.Wait()
+	done := make(chan error, 1)
+	failures := 0
+	var tm *time.Timer
+	var tc <-chan time.Time
+	reset := func() {
+		if tm != nil {
+			tm.Stop()
+			tm, tc = nil, nil
+		}
+		next := us.nextTime(time.Now(), failures)
+		if next.IsZero() {
+			return
+		}
+		log.Infow("次回のデータ更新予定", "time", next)
+		tm = time.NewTimer(time.Until(next))
+		tc = tm.C
+	}
+	defer func() {
+		if tm != nil {
+			tm.Stop()
+		}
+	}()
+	reset()
+	start := func(force bool) {
+		if !atomic.CompareAndSwapInt32(&us.running, 0, 1) {
+			log.Infow("データ更新が実行中のためスキップしました。")
+			return
+		}
+		us.wg.Add(1)
+		go func() {
+			defer us.wg.Done()
+			done <- us.job(ctx, force)
+		}()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			log.Infow("updateScheduler終了")
+			return
+		case <-tc:
+			// データが無い場合はcloneだけ済んで変換に失敗している場合もあるので強制変換する
+			start(failures > 0 && !us.hasData())
+		case force := <-us.trig:
+			log.Infow("データ更新を手動実行します。", "force", force)
+			start(force)
+		case err := <-done:
+			atomic.StoreInt32(&us.running, 0)
+			if err != nil {
+				failures++
+				log.Warnw("データ更新に失敗しました。", "error", err, "failures", failures)
+			} else {
+				failures = 0
+			}
+			reset()
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestScheduler(t *testing.T, enable bool, hasData *atomic.Bool, job func(ctx context.Context, force bool) error) *updateScheduler {
+	t.Helper()
+	conf := DefaultConfig().Update
+	conf.Enable = enable
+	conf.BackoffMin = Duration(10 * time.Millisecond)
+	conf.BackoffMax = Duration(40 * time.Millisecond)
+	us, err := newUpdateScheduler(conf, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	us.hasData = hasData.Load
+	return us
+}
+
+func TestUpdateSchedulerNextTime(t *testing.T) {
+	now := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		enable   bool
+		hasData  bool
+		failures int
+		want     time.Duration
+	}{
+		{"disabled", false, true, 0, 0},
+		{"disabled after failure with data", false, true, 1, 0},
+		{"disabled before first data", false, false, 0, 0},
+		{"disabled retry before first data", false, false, 1, 10 * time.Millisecond},
+		{"disabled backoff grows", false, false, 3, 40 * time.Millisecond},
+		{"enabled backoff", true, true, 2, 20 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hasData atomic.Bool
+			hasData.Store(tt.hasData)
+			us := newTestScheduler(t, tt.enable, &hasData, nil)
+			got := us.nextTime(now, tt.failures)
+			if tt.want == 0 {
+				if !got.IsZero() {
+					t.Fatalf("next = %s, want zero", got)
+				}
+				return
+			}
+			if d := got.Sub(now); d != tt.want {
+				t.Fatalf("next = +%s, want +%s", d, tt.want)
+			}
+		})
+	}
+}
+
+// 定期実行が無効でも、初回の更新に失敗したらデータができるまで再試行する
+func TestUpdateSchedulerRetryFirstUpdate(t *testing.T) {
+	var hasData atomic.Bool
+	var calls atomic.Int32
+	done := make(chan bool, 1)
+	us := newTestScheduler(t, false, &hasData, func(ctx context.Context, force bool) error {
+		if calls.Add(1) < 3 {
+			return errors.New("network")
+		}
+		hasData.Store(true)
+		done <- force
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go us.run(ctx)
+	us.trigger(true)
+	select {
+	case force := <-done:
+		if !force {
+			t.Fatal("retry without data must force conversion")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no retry, calls = %d", calls.Load())
+	}
+	// データができた後は定期実行が無効なので動かない
+	time.Sleep(100 * time.Millisecond)
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("calls = %d, want 3", n)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	ist := time.FixedZone("IST", 5*3600+30*60)
+	utc := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			panic(err)
+		}
+		return v
+	}
+	in := func(loc *time.Location, s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			panic(err)
+		}
+		return v
+	}
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"@hourly", utc("2020-03-01 09:10"), utc("2020-03-01 10:00")},
+		{"@daily", utc("2020-03-01 09:10"), utc("2020-03-02 00:00")},
+		{"@every 90m", utc("2020-03-01 09:10"), utc("2020-03-01 10:40")},
+		{"*/15 * * * *", utc("2020-03-01 09:10"), utc("2020-03-01 09:15")},
+		{"5/15 * * * *", utc("2020-03-01 09:06"), utc("2020-03-01 09:20")},
+		{"5/15 * * * *", utc("2020-03-01 09:50"), utc("2020-03-01 10:05")},
+		{"0-10/5 8,20 * * *", utc("2020-03-01 08:06"), utc("2020-03-01 08:10")},
+		{"0-10/5 8,20 * * *", utc("2020-03-01 08:11"), utc("2020-03-01 20:00")},
+		{"30 9-11 * * *", utc("2020-03-01 11:30"), utc("2020-03-02 09:30")},
+		// 2020-03-04は水曜、7は日曜
+		{"0 0 * * 7", utc("2020-03-04 00:00"), utc("2020-03-08 00:00")},
+		{"0 0 * * 0", utc("2020-03-04 00:00"), utc("2020-03-08 00:00")},
+		{"0 0 * * 1-5", utc("2020-03-06 12:00"), utc("2020-03-09 00:00")},
+		// 日と曜日の両方を指定した場合はどちらかに一致すればよい（2020-04-13は月曜）
+		{"0 0 13 * 5", utc("2020-04-11 00:00"), utc("2020-04-13 00:00")},
+		{"0 0 13 * 5", utc("2020-04-13 00:00"), utc("2020-04-17 00:00")},
+		// 曜日が*の場合は日だけで判定する
+		{"0 0 13 * *", utc("2020-04-14 00:00"), utc("2020-05-13 00:00")},
+		{"0 0 1 */3 *", utc("2020-02-10 00:00"), utc("2020-04-01 00:00")},
+		{"0 0 29 2 *", utc("2021-01-01 00:00"), utc("2024-02-29 00:00")},
+		// +05:30の地域でも正時に動く
+		{"0 10 * * *", in(ist, "2020-03-01 09:10"), in(ist, "2020-03-01 10:00")},
+		{"0 * * * *", in(ist, "2020-03-01 09:10"), in(ist, "2020-03-01 10:00")},
+		{"30 * * * *", in(ist, "2020-03-01 09:10"), in(ist, "2020-03-01 09:30")},
+		// 存在しない日付はゼロ値
+		{"0 0 30 2 *", utc("2020-01-01 00:00"), time.Time{}},
+		{"0 0 31 4 *", utc("2020-01-01 00:00"), time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if got := s.next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q from %s = %s, want %s", tt.spec, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"@every",
+		"@every 0s",
+		"@every -1m",
+		"@every x",
+		"@yearly",
+	} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("%q: want error", spec)
+		}
+	}
+}
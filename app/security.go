@@ -0,0 +1,137 @@
+package app
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultContentSecurityPolicy 同梱のd3/bootstrap/vueに合わせたCSP
+// vueはテンプレートのコンパイルにnew Functionを使うのでunsafe-evalが必要
+// HTMLに<style>を直接書いているのでunsafe-inlineが必要
+const DefaultContentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-eval'; " +
+	"style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data:; " +
+	"font-src 'self' data:; " +
+	"connect-src 'self'; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'"
+
+// SecurityConfig セキュリティ関連ヘッダの設定
+// 空文字や0の項目はヘッダを付けない
+type SecurityConfig struct {
+	// 平文HTTPへのアクセスをHTTPSへリダイレクトする
+	RedirectHTTPS bool `json:"redirect_https"`
+	// リダイレクト先のポート（443以外で待ち受けている場合）
+	HTTPSPort int `json:"https_port"`
+	// Strict-Transport-Securityのmax-age（HTTPSのレスポンスにだけ付ける）
+	HSTSMaxAge            Duration `json:"hsts_max_age"`
+	HSTSIncludeSubdomains bool     `json:"hsts_include_subdomains"`
+	HSTSPreload           bool     `json:"hsts_preload"`
+	ContentSecurityPolicy string   `json:"content_security_policy"`
+	ContentTypeNosniff    bool     `json:"content_type_nosniff"`
+	ReferrerPolicy        string   `json:"referrer_policy"`
+	FrameOptions          string   `json:"frame_options"`
+}
+
+func defaultSecurityConfig() SecurityConfig {
+	return SecurityConfig{
+		ContentSecurityPolicy: DefaultContentSecurityPolicy,
+		ContentTypeNosniff:    true,
+		ReferrerPolicy:        "strict-origin-when-cross-origin",
+		FrameOptions:          "DENY",
+	}
+}
+
+// middleware ハンドラを包む処理
+type middleware func(http.Handler) http.Handler
+
+// chain 先に指定したものほど外側になる
+func chain(h http.Handler, ms ...middleware) http.Handler {
+	for i := len(ms) - 1; i >= 0; i-- {
+		h = ms[i](h)
+	}
+	return h
+}
+
+// securityMiddlewares 設定で有効なものだけを並べる
+func securityMiddlewares(conf SecurityConfig) []middleware {
+	ms := []middleware{}
+	if conf.RedirectHTTPS {
+		ms = append(ms, httpsRedirect(conf.HTTPSPort))
+	}
+	ms = append(ms, securityHeaders(conf))
+	return ms
+}
+
+// httpsRedirect 平文HTTPのリクエストをHTTPSへ転送する
+// 死活監視は対象外
+// ACMEの証明書はTLS-ALPN-01でTLSの待ち受け側が取得するので、HTTP-01の経路は用意しない
+func httpsRedirect(port int) middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" || !redirectable(r.URL.Path) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			host := r.Host
+			if hst, _, err := net.SplitHostPort(host); err == nil {
+				host = hst
+			}
+			if host == "" {
+				http.Error(w, "Hostヘッダがありません。", http.StatusBadRequest)
+				return
+			}
+			if port != 0 && port != 443 {
+				host = net.JoinHostPort(host, strconv.Itoa(port))
+			}
+			code := http.StatusMovedPermanently
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				code = http.StatusPermanentRedirect
+			}
+			http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+		})
+	}
+}
+
+func redirectable(p string) bool {
+	return p != "/healthz" && p != "/readyz"
+}
+
+func securityHeaders(conf SecurityConfig) middleware {
+	var hsts string
+	if conf.HSTSMaxAge > 0 {
+		hsts = "max-age=" + strconv.FormatInt(int64(time.Duration(conf.HSTSMaxAge)/time.Second), 10)
+		if conf.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if conf.HSTSPreload {
+			hsts += "; preload"
+		}
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := w.Header()
+			if hsts != "" && r.TLS != nil {
+				header.Set("Strict-Transport-Security", hsts)
+			}
+			if conf.ContentSecurityPolicy != "" {
+				header.Set("Content-Security-Policy", conf.ContentSecurityPolicy)
+			}
+			if conf.ContentTypeNosniff {
+				header.Set("X-Content-Type-Options", "nosniff")
+			}
+			if conf.ReferrerPolicy != "" {
+				header.Set("Referrer-Policy", conf.ReferrerPolicy)
+			}
+			if conf.FrameOptions != "" {
+				header.Set("X-Frame-Options", conf.FrameOptions)
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Assets 実行ファイルに埋め込んだ静的ファイル（wwwの中身）
+// nilの場合はPublicPathを配信する
+var Assets fs.FS
+
+// StaticConfig 静的ファイルの配信元
+type StaticConfig struct {
+	// 指定した場合は埋め込みのファイルより優先してディスクから配信する（開発用）
+	Dir string `json:"dir"`
+}
+
+func (conf StaticConfig) validate() error {
+	if conf.Dir == "" {
+		return nil
+	}
+	st, err := os.Stat(conf.Dir)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("静的ファイルの配信元がフォルダではありません。:%s", conf.Dir)
+	}
+	return nil
+}
+
+// staticFS 配信元の選択
+func staticFS(conf StaticConfig) (fs.FS, string) {
+	switch {
+	case conf.Dir != "":
+		return os.DirFS(conf.Dir), conf.Dir
+	case Assets != nil:
+		return Assets, "embed"
+	}
+	return os.DirFS(PublicPath), PublicPath
+}
+
+// newStaticHandler 変換したデータは実行時に生成されるので常にディスクから配信する
+func newStaticHandler(conf StaticConfig) http.Handler {
+	fsys, src := staticFS(conf)
+	log.Infow("静的ファイルの配信元", "source", src)
+	files := http.FileServer(http.FS(fsys))
+	data := http.FileServer(http.FS(os.DirFS(PublicPath)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/data/") {
+			data.ServeHTTP(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
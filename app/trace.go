@@ -0,0 +1,202 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// リクエストIDとW3C Trace Context（traceparent）の簡易実装
+// スパンはOpenTelemetryのOTLP/JSONに近い形で1行ずつファイルに出力する
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	spanKey
+)
+
+const (
+	HeaderRequestID   = "X-Request-ID"
+	HeaderTraceparent = "traceparent"
+)
+
+var requestIDPattern = regexp.MustCompile(`^[0-9A-Za-z._\-]{1,128}$`)
+var traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// newRequestID 受け取ったX-Request-IDが妥当ならそれを使う
+func newRequestID(r *http.Request) string {
+	if id := r.Header.Get(HeaderRequestID); requestIDPattern.MatchString(id) {
+		return id
+	}
+	return randomHex(16)
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestLogger リクエストIDとトレースIDを付けたアプリケーションログ
+func requestLogger(ctx context.Context) *zap.SugaredLogger {
+	l := log
+	if id := requestIDFrom(ctx); id != "" {
+		l = l.With("request_id", id)
+	}
+	if sp := spanFrom(ctx); sp != nil {
+		l = l.With("trace_id", sp.TraceID, "span_id", sp.SpanID)
+	}
+	return l
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		// 乱数が取れないことはまず無いが、その場合は時刻で代用する
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// span 1区間の処理
+type span struct {
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         string                 `json:"kind"`
+	Start        int64                  `json:"start_time_unix_nano"`
+	End          int64                  `json:"end_time_unix_nano"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Status       string                 `json:"status"`
+	tracer       *tracer
+}
+
+// tracer スパンの出力先
+type tracer struct {
+	sync.Mutex
+	fp     *os.File
+	enc    *json.Encoder
+	closed bool
+}
+
+// tracing 無効の場合はnil、設定の再読み込みで差し替わる
+var tracing atomic.Pointer[tracer]
+
+func newTracer(p string) (*tracer, error) {
+	fp, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &tracer{fp: fp, enc: json.NewEncoder(fp)}, nil
+}
+
+func (t *tracer) export(sp *span) {
+	t.Lock()
+	defer t.Unlock()
+	if t.closed {
+		// 差し替え前に始まったスパンは捨てる
+		return
+	}
+	if err := t.enc.Encode(sp); err != nil {
+		log.Warnw("スパンの出力に失敗しました。", "error", err)
+	}
+}
+
+func (t *tracer) close() error {
+	t.Lock()
+	defer t.Unlock()
+	t.closed = true
+	return t.fp.Close()
+}
+
+func spanFrom(ctx context.Context) *span {
+	sp, _ := ctx.Value(spanKey).(*span)
+	return sp
+}
+
+// startSpan ctxに親スパンがあればその子にする
+// トレースが無効の場合はnilを返す（nilのままメソッドを呼んでよい）
+func startSpan(ctx context.Context, name, kind string) (context.Context, *span) {
+	t := tracing.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	sp := &span{
+		SpanID: randomHex(8),
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now().UnixNano(),
+		Status: "OK",
+		tracer: t,
+	}
+	if parent := spanFrom(ctx); parent != nil {
+		sp.TraceID = parent.TraceID
+		sp.ParentSpanID = parent.SpanID
+	} else {
+		sp.TraceID = randomHex(16)
+	}
+	return context.WithValue(ctx, spanKey, sp), sp
+}
+
+// startServerSpan traceparentヘッダがあれば呼び出し元のトレースを引き継ぐ
+func startServerSpan(r *http.Request, name string) (context.Context, *span) {
+	ctx := r.Context()
+	if tracing.Load() == nil {
+		return ctx, nil
+	}
+	if m := traceparentPattern.FindStringSubmatch(r.Header.Get(HeaderTraceparent)); m != nil && m[1] != "00000000000000000000000000000000" && m[2] != "0000000000000000" {
+		ctx = context.WithValue(ctx, spanKey, &span{TraceID: m[1], SpanID: m[2]})
+	}
+	return startSpan(ctx, name, "server")
+}
+
+func (sp *span) setAttr(key string, v interface{}) {
+	if sp == nil {
+		return
+	}
+	if sp.Attributes == nil {
+		sp.Attributes = make(map[string]interface{})
+	}
+	sp.Attributes[key] = v
+}
+
+func (sp *span) setError(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.Status = "ERROR"
+	sp.setAttr("error", err.Error())
+}
+
+func (sp *span) end() {
+	if sp == nil {
+		return
+	}
+	sp.End = time.Now().UnixNano()
+	sp.tracer.export(sp)
+}
+
+// tracedHandler ハンドラをスパンで囲む
+func tracedHandler(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, sp := startSpan(r.Context(), name, "internal")
+		defer sp.end()
+		sp.setAttr("url.path", r.URL.Path)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
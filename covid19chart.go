@@ -2,13 +2,22 @@ package main
 
 import (
 	"context"
+	"embed"
+	"flag"
 	"fmt"
+	"io/fs"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/tanaton/covid-19-chart/app"
 )
 
+// www/dataは実行時に生成するデータなので埋め込まない
+//
+//go:embed www/*.html www/favicon.ico www/chart www/css www/js
+var www embed.FS
+
 func main() {
 	defer func() {
 		if err := recover(); err != nil {
@@ -23,13 +32,104 @@ func _main() int {
 	if envvar := os.Getenv("GOMAXPROCS"); envvar == "" {
 		runtime.GOMAXPROCS(runtime.NumCPU())
 	}
+	confpath := flag.String("config", "", "設定ファイル(JSON)のパス")
+	flag.Parse()
+	conf, err := app.LoadConfig(*confpath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 1
+	}
+	switch flag.Arg(0) {
+	case "analyze-logs":
+		return analyzeLogs(conf, flag.Args()[1:])
+	case "rebuild":
+		return rebuild(conf, flag.Args()[1:])
+	case "diff-revisions":
+		return diffRevisions(conf, flag.Args()[1:])
+	}
+	assets, err := fs.Sub(www, "www")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 1
+	}
+	app.Assets = assets
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	chart := app.New()
+	chart := app.New(conf)
 	if err := chart.Run(ctx); err != nil {
 		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
 		return 1
 	}
 	return 0
 }
+
+// analyzeLogs アクセスログの集計
+func analyzeLogs(conf *app.Config, args []string) int {
+	flags := flag.NewFlagSet("analyze-logs", flag.ContinueOnError)
+	opts := app.AnalyzeOptions{Filename: conf.AccessLog.Filename}
+	flags.StringVar(&opts.Dir, "dir", app.AccessLogPath, "アクセスログのフォルダ")
+	flags.StringVar(&opts.Format, "format", "text", "出力形式(text/json)")
+	flags.IntVar(&opts.Top, "top", 10, "URIとUser-Agentの上位件数")
+	since := flags.String("since", "", "集計開始日時(RFC3339)")
+	until := flags.String("until", "", "集計終了日時(RFC3339)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	opts.Files = flags.Args()
+	for _, it := range []struct {
+		s string
+		t *time.Time
+	}{{*since, &opts.Since}, {*until, &opts.Until}} {
+		if it.s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, it.s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+			return 2
+		}
+		*it.t = t
+	}
+	if err := app.AnalyzeLogs(os.Stdout, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// rebuild 過去のコミット時点のデータを変換する
+func rebuild(conf *app.Config, args []string) int {
+	flags := flag.NewFlagSet("rebuild", flag.ContinueOnError)
+	opts := app.RebuildOptions{AliasPath: conf.AliasPath}
+	flags.StringVar(&opts.Repo, "repo", app.GitPath, "元データのリポジトリ（全履歴）")
+	flags.StringVar(&opts.Rev, "rev", "HEAD", "コミットまたは日付(2006-01-02)")
+	flags.StringVar(&opts.Out, "out", "", "出力先のフォルダ（省略時は"+app.RebuildDataPath+"/<コミット>）")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if err := app.Rebuild(os.Stdout, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// diffRevisions 2つのコミット時点の変換結果の差分
+func diffRevisions(conf *app.Config, args []string) int {
+	flags := flag.NewFlagSet("diff-revisions", flag.ContinueOnError)
+	opts := app.DiffOptions{AliasPath: conf.AliasPath}
+	flags.StringVar(&opts.Repo, "repo", app.GitPath, "元データのリポジトリ（全履歴）")
+	flags.StringVar(&opts.From, "from", "HEAD~1", "比較元のコミットまたは日付(2006-01-02)")
+	flags.StringVar(&opts.To, "to", "HEAD", "比較先のコミットまたは日付(2006-01-02)")
+	flags.StringVar(&opts.Format, "format", "text", "出力形式(text/json)")
+	flags.IntVar(&opts.Top, "top", 50, "国単位の変更の上位件数（0で全て）")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if err := app.DiffRevisions(os.Stdout, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error:%s\n", err)
+		return 1
+	}
+	return 0
+}